@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/client"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// defaultBucketName is the name of a bucket configured without a name, e.g.
+// through --objstoreto.config.
+const defaultBucketName = "default"
+
+// replicationOrigin is a named bucket blocks are replicated from.
+type replicationOrigin struct {
+	name string
+	bkt  objstore.BucketReader
+}
+
+// replicationTarget is a named bucket blocks are replicated to.
+type replicationTarget struct {
+	name string
+	bkt  objstore.Bucket
+}
+
+// namedBucketConfig is the object store configuration of a named bucket.
+type namedBucketConfig struct {
+	name    string
+	content []byte
+	// prefix is the directory of the bucket the blocks are stored in.
+	prefix string
+}
+
+// bucketConfigs returns the configurations of the buckets configured either by
+// a single object store configuration, named after defaultBucketName, or by a
+// list of named ones. Setting both is an error. The prefix applies to all
+// buckets not configuring their own.
+func bucketConfigs(single, named []byte, prefix string) ([]namedBucketConfig, error) {
+	switch {
+	case len(single) > 0 && len(named) > 0:
+		return nil, errors.New("only one of a single and a list of named object store configurations can be set")
+	case len(single) > 0:
+		return []namedBucketConfig{{name: defaultBucketName, content: single, prefix: prefix}}, nil
+	case len(named) > 0:
+		confs, err := parseNamedBucketConfigs(named)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range confs {
+			if confs[i].prefix == "" {
+				confs[i].prefix = prefix
+			}
+		}
+
+		return confs, nil
+	}
+
+	return nil, nil
+}
+
+// parseNamedBucketConfigs parses a YAML list of object store configurations
+// in the usual Thanos format, with an additional unique name field and an
+// optional prefix field.
+func parseNamedBucketConfigs(content []byte) ([]namedBucketConfig, error) {
+	var confs []struct {
+		Name   string             `yaml:"name"`
+		Prefix string             `yaml:"prefix"`
+		Type   client.ObjProvider `yaml:"type"`
+		Config interface{}        `yaml:"config"`
+	}
+
+	if err := yaml.UnmarshalStrict(content, &confs); err != nil {
+		return nil, errors.Wrap(err, "parse YAML")
+	}
+
+	named := make([]namedBucketConfig, 0, len(confs))
+	seen := map[string]struct{}{}
+
+	for i, conf := range confs {
+		if conf.Name == "" {
+			return nil, errors.Errorf("bucket %d has no name", i)
+		}
+
+		if _, ok := seen[conf.Name]; ok {
+			return nil, errors.Errorf("duplicate bucket name %q", conf.Name)
+		}
+
+		seen[conf.Name] = struct{}{}
+
+		bucketContent, err := yaml.Marshal(client.BucketConfig{Type: conf.Type, Config: conf.Config})
+		if err != nil {
+			return nil, errors.Wrapf(err, "marshal configuration of bucket %q", conf.Name)
+		}
+
+		named = append(named, namedBucketConfig{name: conf.Name, content: bucketContent, prefix: conf.Prefix})
+	}
+
+	return named, nil
+}
+
+// prefixedBucket is a bucket whose objects are all stored under a prefix,
+// which is hidden from its users.
+type prefixedBucket struct {
+	objstore.Bucket
+
+	prefix string
+}
+
+// newPrefixedBucket returns a bucket storing all objects under the prefix
+// directory, or the bucket itself if the prefix is empty.
+func newPrefixedBucket(bkt objstore.Bucket, prefix string) objstore.Bucket {
+	prefix = strings.Trim(prefix, objstore.DirDelim)
+	if prefix == "" {
+		return bkt
+	}
+
+	return &prefixedBucket{Bucket: bkt, prefix: prefix}
+}
+
+func (b *prefixedBucket) fullName(name string) string {
+	return b.prefix + objstore.DirDelim + name
+}
+
+// Iter calls f for each entry in the given directory, with the prefix removed
+// from the entry names.
+func (b *prefixedBucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+	return b.Bucket.Iter(ctx, b.fullName(dir), func(name string) error {
+		return f(strings.TrimPrefix(name, b.prefix+objstore.DirDelim))
+	})
+}
+
+func (b *prefixedBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return b.Bucket.Get(ctx, b.fullName(name))
+}
+
+func (b *prefixedBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	return b.Bucket.GetRange(ctx, b.fullName(name), off, length)
+}
+
+func (b *prefixedBucket) Exists(ctx context.Context, name string) (bool, error) {
+	return b.Bucket.Exists(ctx, b.fullName(name))
+}
+
+func (b *prefixedBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	return b.Bucket.Upload(ctx, b.fullName(name), r)
+}
+
+func (b *prefixedBucket) Delete(ctx context.Context, name string) error {
+	return b.Bucket.Delete(ctx, b.fullName(name))
+}
+
+// Name returns the bucket name for the provider, followed by the prefix.
+func (b *prefixedBucket) Name() string {
+	return b.Bucket.Name() + objstore.DirDelim + b.prefix
+}
+
+// uploadToTargets streams r to all targets at once, so that it is read only
+// once. It returns the upload error and the number of bytes written of every
+// target, in the order of the targets. A failing target does not affect the
+// uploads to the others, while the slowest target determines the pace of all
+// of them.
+func uploadToTargets(ctx context.Context, name string, r io.Reader, targets []*replicationTarget) ([]error, []int64) {
+	errs := make([]error, len(targets))
+	written := make([]int64, len(targets))
+
+	if len(targets) == 1 {
+		cr := &countingReader{r: r}
+		errs[0] = targets[0].bkt.Upload(ctx, name, cr)
+		written[0] = cr.n
+
+		return errs, written
+	}
+
+	writers := make([]*io.PipeWriter, len(targets))
+	done := make(chan struct{}, len(targets))
+
+	for i, t := range targets {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+
+		go func(i int, t *replicationTarget, pr *io.PipeReader) {
+			defer func() { done <- struct{}{} }()
+
+			cr := &countingReader{r: pr}
+			errs[i] = t.bkt.Upload(ctx, name, cr)
+			written[i] = cr.n
+
+			// Unblock writes in case the upload returned without reading
+			// the whole object.
+			if errs[i] != nil {
+				pr.CloseWithError(errs[i])
+			} else {
+				pr.CloseWithError(errUploadIncomplete)
+			}
+		}(i, t, pr)
+	}
+
+	var (
+		buf     = make([]byte, 32*1024)
+		readErr error
+		active  = len(targets)
+		failed  = make([]bool, len(targets))
+	)
+
+	for active > 0 {
+		n, err := r.Read(buf)
+
+		for i, w := range writers {
+			if n == 0 || failed[i] {
+				continue
+			}
+
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				failed[i] = true
+				active--
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			readErr = err
+			break
+		}
+	}
+
+	for _, w := range writers {
+		// Closing with a nil error makes the reader return io.EOF.
+		w.CloseWithError(readErr)
+	}
+
+	for range targets {
+		<-done
+	}
+
+	for i := range errs {
+		if errs[i] == nil && failed[i] {
+			errs[i] = errUploadIncomplete
+		}
+
+		if errs[i] == nil && readErr != nil {
+			errs[i] = errors.Wrap(readErr, "read object")
+		}
+	}
+
+	return errs, written
+}
+
+var errUploadIncomplete = errors.New("upload finished before the whole object was read")
+
+// countingReader counts the bytes read from a reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+
+	return n, err
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/run"
+	"github.com/oklog/ulid"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	thanosblock "github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/extflag"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/client"
+	"github.com/thanos-io/thanos/pkg/runutil"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+func registerDiff(m map[string]setupFunc, app *kingpin.Application, name string) {
+	cmd := app.Command(name, "Compares the blocks of an origin and a target bucket, exiting with code 3 if they differ and 1 on failures.")
+
+	fromObjStoreConfig := regCommonObjStoreFlags(cmd, "from", false)
+	fromPrefix := cmd.Flag("from.prefix", "Directory of the origin bucket the blocks are stored in, e.g. thanos/prod.").Default("").String()
+	toObjStoreConfig := regCommonObjStoreFlags(cmd, "to", false)
+	toPrefix := cmd.Flag("to.prefix", "Directory of the target bucket the blocks are stored in, e.g. thanos/dr.").Default("").String()
+
+	filterFlags := regBlockFilterFlags(cmd, "compared")
+
+	metaRewriteFlags := regMetaRewriteFlags(cmd)
+
+	consistencyDelay := cmd.Flag("consistency-delay", "Minimum age of blocks, based on their ULID, before they are compared. Set it like for the run command, so that blocks not replicated yet are not reported.").Default("0s").Duration()
+
+	output := cmd.Flag("output", "Output format of the differences.").
+		Default(string(outputFormatTable)).Enum(string(outputFormatTable), string(outputFormatJSON))
+
+	m[name] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, _ opentracing.Tracer, _ bool) error {
+		filterConf, err := filterFlags.parse()
+		if err != nil {
+			return err
+		}
+
+		injectLabels, relabelConfigs, err := metaRewriteFlags.parse()
+		if err != nil {
+			return err
+		}
+
+		return runDiff(
+			g,
+			logger,
+			reg,
+			filterConf,
+			diffOptions{
+				injectLabels:     injectLabels,
+				relabelConfigs:   relabelConfigs,
+				consistencyDelay: *consistencyDelay,
+			},
+			fromObjStoreConfig,
+			*fromPrefix,
+			toObjStoreConfig,
+			*toPrefix,
+			outputFormat(*output),
+		)
+	}
+}
+
+func runDiff(
+	g *run.Group,
+	logger log.Logger,
+	reg *prometheus.Registry,
+	filterConf blockFilterConfig,
+	opts diffOptions,
+	fromObjStoreConfig *extflag.PathOrContent,
+	fromPrefix string,
+	toObjStoreConfig *extflag.PathOrContent,
+	toPrefix string,
+	output outputFormat,
+) error {
+	logger = log.With(logger, "component", "diff")
+
+	originBkt, err := newBucketFromConfig(logger, reg, fromObjStoreConfig, fromPrefix, "from")
+	if err != nil {
+		return errors.Wrap(err, "create origin bucket")
+	}
+
+	targetBkt, err := newBucketFromConfig(logger, reg, toObjStoreConfig, toPrefix, "to")
+	if err != nil {
+		runutil.CloseWithLogOnErr(logger, originBkt, "from bucket client")
+		return errors.Wrap(err, "create target bucket")
+	}
+
+	// Filtered blocks are not reported as metrics, as the command does not
+	// serve any.
+	blockFilter := filterConf.newBlockFilter(logger, newReplicationMetrics(nil).blocksFiltered).FilterReason
+	ctx, cancel := context.WithCancel(context.Background())
+
+	g.Add(func() error {
+		defer runutil.CloseWithLogOnErr(logger, originBkt, "from bucket client")
+		defer runutil.CloseWithLogOnErr(logger, targetBkt, "to bucket client")
+
+		d, err := diffBuckets(ctx, logger, originBkt, targetBkt, blockFilter, opts)
+		if err != nil {
+			return errors.Wrap(err, "compare buckets")
+		}
+
+		if err := d.write(os.Stdout, output); err != nil {
+			return errors.Wrap(err, "write differences")
+		}
+
+		if n := d.count(); n > 0 {
+			return errors.Wrapf(errBucketsDiffer, "found %d differences", n)
+		}
+
+		level.Info(logger).Log("msg", "buckets do not differ")
+
+		return nil
+	}, func(error) {
+		cancel()
+	})
+
+	return nil
+}
+
+// newBucketFromConfig creates the bucket of a single object store
+// configuration, labeling its metrics like the default bucket of the run
+// command.
+func newBucketFromConfig(logger log.Logger, reg prometheus.Registerer, conf *extflag.PathOrContent, prefix, direction string) (objstore.Bucket, error) {
+	confContentYaml, err := conf.Content()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(confContentYaml) == 0 {
+		return nil, errors.Errorf("no object store configuration set with --objstore%s.config", direction)
+	}
+
+	bkt, err := client.NewBucket(
+		logger,
+		confContentYaml,
+		prometheus.WrapRegistererWith(prometheus.Labels{"replicate": direction, "replicate_bucket": defaultBucketName}, reg),
+		replicateComponent,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPrefixedBucket(bkt, prefix), nil
+}
+
+// errBucketsDiffer is returned by the diff command if the buckets differ. The
+// command then exits with exitCodeBucketsDiffer instead of the exit code of
+// failures.
+var errBucketsDiffer = errors.New("buckets differ")
+
+const exitCodeBucketsDiffer = 3
+
+// diffOptions configures how origin blocks are expected to be replicated.
+type diffOptions struct {
+	// injectLabels and relabelConfigs change the external labels of
+	// replicated blocks, see replicationOptions.
+	injectLabels   labels.Labels
+	relabelConfigs []*relabel.Config
+	// consistencyDelay is the minimum age of a block, based on its ULID,
+	// before it is compared.
+	consistencyDelay time.Duration
+}
+
+// Kinds of differences between an origin and a target block.
+const (
+	differenceOnlyInOrigin   = "only-in-origin"
+	differenceOnlyInTarget   = "only-in-target"
+	differenceMeta           = "different-meta"
+	differenceMissingObjects = "missing-objects"
+)
+
+// bucketDiff holds the differences between the blocks of an origin and a
+// target bucket.
+type bucketDiff struct {
+	OnlyInOrigin   []ulid.ULID           `json:"only_in_origin"`
+	OnlyInTarget   []ulid.ULID           `json:"only_in_target"`
+	DifferentMeta  []ulid.ULID           `json:"different_meta"`
+	MissingObjects []blockMissingObjects `json:"missing_objects"`
+}
+
+// blockMissingObjects are the objects of an origin block missing in the
+// target bucket.
+type blockMissingObjects struct {
+	ULID    ulid.ULID `json:"ulid"`
+	Objects []string  `json:"objects"`
+}
+
+// count returns the number of differences.
+func (d *bucketDiff) count() int {
+	return len(d.OnlyInOrigin) + len(d.OnlyInTarget) + len(d.DifferentMeta) + len(d.MissingObjects)
+}
+
+// write writes the differences in the given format.
+func (d *bucketDiff) write(w io.Writer, format outputFormat) error {
+	if format == outputFormatJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(d)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "BLOCK\tDIFFERENCE\tOBJECT")
+
+	for _, id := range d.OnlyInOrigin {
+		fmt.Fprintf(tw, "%s\t%s\t\n", id, differenceOnlyInOrigin)
+	}
+
+	for _, id := range d.OnlyInTarget {
+		fmt.Fprintf(tw, "%s\t%s\t\n", id, differenceOnlyInTarget)
+	}
+
+	for _, id := range d.DifferentMeta {
+		fmt.Fprintf(tw, "%s\t%s\t\n", id, differenceMeta)
+	}
+
+	for _, b := range d.MissingObjects {
+		for _, o := range b.Objects {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", b.ULID, differenceMissingObjects, o)
+		}
+	}
+
+	fmt.Fprintln(tw)
+	fmt.Fprintf(tw, "%d differences.\n", d.count())
+
+	return tw.Flush()
+}
+
+// diffBuckets compares the blocks of the origin and target buckets selected by
+// the block filter. Origin metas are compared after changing their external
+// labels the way they are replicated. Blocks without a complete meta file are
+// ignored, they are still being uploaded or deleted, and so are blocks younger
+// than the consistency delay.
+func diffBuckets(ctx context.Context, logger log.Logger, origin, target objstore.BucketReader, blockFilter blockFilterFunc, opts diffOptions) (*bucketDiff, error) {
+	originMetas, err := loadBlockMetas(ctx, logger, origin)
+	if err != nil {
+		return nil, errors.Wrap(err, "load origin blocks")
+	}
+
+	targetMetas, err := loadBlockMetas(ctx, logger, target)
+	if err != nil {
+		return nil, errors.Wrap(err, "load target blocks")
+	}
+
+	d := &bucketDiff{
+		OnlyInOrigin:   []ulid.ULID{},
+		OnlyInTarget:   []ulid.ULID{},
+		DifferentMeta:  []ulid.ULID{},
+		MissingObjects: []blockMissingObjects{},
+	}
+
+	tooYoung := func(id ulid.ULID) bool {
+		return ulid.Now()-id.Time() < uint64(opts.consistencyDelay/time.Millisecond)
+	}
+
+	for _, id := range sortedBlockIDs(originMetas) {
+		meta := originMetas[id]
+		if meta == nil || tooYoung(id) {
+			continue
+		}
+
+		// Blocks left without external labels are not replicated.
+		rewriteMeta(meta, opts.injectLabels, opts.relabelConfigs)
+
+		if len(meta.Thanos.Labels) == 0 || blockFilter(meta) != "" {
+			continue
+		}
+
+		targetMeta, ok := targetMetas[id]
+		if !ok {
+			d.OnlyInOrigin = append(d.OnlyInOrigin, id)
+			continue
+		}
+
+		if targetMeta != nil && !reflect.DeepEqual(meta, targetMeta) {
+			d.DifferentMeta = append(d.DifferentMeta, id)
+		}
+
+		missing, err := missingBlockObjects(ctx, origin, target, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(missing) > 0 {
+			d.MissingObjects = append(d.MissingObjects, blockMissingObjects{ULID: id, Objects: missing})
+		}
+	}
+
+	for _, id := range sortedBlockIDs(targetMetas) {
+		if _, ok := originMetas[id]; ok {
+			continue
+		}
+
+		meta := targetMetas[id]
+		if meta == nil || tooYoung(id) || blockFilter(meta) != "" {
+			continue
+		}
+
+		d.OnlyInTarget = append(d.OnlyInTarget, id)
+	}
+
+	return d, nil
+}
+
+// loadBlockMetas returns the metas of all blocks in the bucket, which are nil
+// for blocks without a complete meta file.
+func loadBlockMetas(ctx context.Context, logger log.Logger, bkt objstore.BucketReader) (map[ulid.ULID]*metadata.Meta, error) {
+	metas := map[ulid.ULID]*metadata.Meta{}
+
+	if err := bkt.Iter(ctx, "", func(name string) error {
+		id, ok := thanosblock.IsBlockDir(name)
+		if !ok {
+			return nil
+		}
+
+		meta, metaNonExistentOrPartial, err := loadMeta(ctx, bkt, id)
+		if metaNonExistentOrPartial {
+			level.Debug(logger).Log("msg", "block meta not uploaded yet. Ignoring.", "block_uuid", id.String())
+			metas[id] = nil
+
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("load meta for block %v: %w", id.String(), err)
+		}
+
+		metas[id] = meta
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("iterate over bucket: %w", err)
+	}
+
+	return metas, nil
+}
+
+// sortedBlockIDs returns the IDs of the blocks oldest first.
+func sortedBlockIDs(metas map[ulid.ULID]*metadata.Meta) []ulid.ULID {
+	ids := make([]ulid.ULID, 0, len(metas))
+
+	for id := range metas {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].Compare(ids[j]) < 0
+	})
+
+	return ids
+}
+
+// missingBlockObjects returns the objects of the origin block missing in the
+// target bucket.
+func missingBlockObjects(ctx context.Context, origin, target objstore.BucketReader, id ulid.ULID) ([]string, error) {
+	originObjects := []string{}
+
+	if err := iterRecursive(ctx, origin, id.String(), func(name string) error {
+		originObjects = append(originObjects, name)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("iterate over origin block %v: %w", id.String(), err)
+	}
+
+	targetObjects := map[string]struct{}{}
+
+	if err := iterRecursive(ctx, target, id.String(), func(name string) error {
+		targetObjects[name] = struct{}{}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("iterate over target block %v: %w", id.String(), err)
+	}
+
+	missing := []string{}
+
+	for _, name := range originObjects {
+		if _, ok := targetObjects[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+
+	sort.Strings(missing)
+
+	return missing, nil
+}
+
+// iterRecursive calls f for every object in the directory and its
+// subdirectories.
+func iterRecursive(ctx context.Context, bkt objstore.BucketReader, dir string, f func(string) error) error {
+	return bkt.Iter(ctx, dir, func(name string) error {
+		if strings.HasSuffix(name, objstore.DirDelim) {
+			return iterRecursive(ctx, bkt, path.Clean(name), f)
+		}
+
+		return f(name)
+	})
+}
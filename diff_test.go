@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+)
+
+func TestDiffBuckets(t *testing.T) {
+	ctx := context.Background()
+	logger := testLogger(t.Name())
+	originBucket, targetBucket := inmem.NewBucket(), inmem.NewBucket()
+
+	upload := func(bkt objstore.Bucket, meta *metadata.Meta, withChunks bool) {
+		b, err := json.Marshal(meta)
+		testutil.Ok(t, err)
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(meta.ULID.String(), "meta.json"), bytes.NewReader(b)))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(meta.ULID.String(), "index"), bytes.NewReader(nil)))
+
+		if withChunks {
+			testutil.Ok(t, bkt.Upload(ctx, path.Join(meta.ULID.String(), "chunks", "000001"), bytes.NewReader(nil)))
+		}
+	}
+
+	// A block present in both buckets.
+	upload(originBucket, testMeta(testULID(0)), true)
+	upload(targetBucket, testMeta(testULID(0)), true)
+
+	// A block only present in the origin.
+	upload(originBucket, testMeta(testULID(1)), true)
+
+	// A block only present in the target.
+	upload(targetBucket, testMeta(testULID(2)), true)
+
+	// A block with a different meta.
+	upload(originBucket, testMeta(testULID(3)), true)
+
+	different := testMeta(testULID(3))
+	different.Thanos.Labels["other"] = "value"
+	upload(targetBucket, different, true)
+
+	// A block missing objects in the target.
+	upload(originBucket, testMeta(testULID(4)), true)
+	upload(targetBucket, testMeta(testULID(4)), false)
+
+	// Blocks not selected by the block filters.
+	filtered := testMeta(testULID(5))
+	filtered.Thanos.Labels = map[string]string{"other": "value"}
+	upload(originBucket, filtered, true)
+
+	filtered = testMeta(testULID(6))
+	filtered.Thanos.Labels = map[string]string{"other": "value"}
+	upload(targetBucket, filtered, true)
+
+	// A block still being uploaded to the origin.
+	testutil.Ok(t, originBucket.Upload(ctx, path.Join(testULID(7).String(), "index"), bytes.NewReader(nil)))
+
+	filter := testBlockFilter(logger, newReplicationMetrics(nil).blocksFiltered)
+
+	d, err := diffBuckets(ctx, logger, originBucket, targetBucket, filter, diffOptions{})
+	testutil.Ok(t, err)
+
+	testutil.Equals(t, &bucketDiff{
+		OnlyInOrigin:  []ulid.ULID{testULID(1)},
+		OnlyInTarget:  []ulid.ULID{testULID(2)},
+		DifferentMeta: []ulid.ULID{testULID(3)},
+		MissingObjects: []blockMissingObjects{
+			{ULID: testULID(4), Objects: []string{path.Join(testULID(4).String(), "chunks", "000001")}},
+		},
+	}, d)
+	testutil.Equals(t, 4, d.count())
+
+	var buf bytes.Buffer
+	testutil.Ok(t, d.write(&buf, outputFormatTable))
+	testutil.Assert(t, strings.Contains(buf.String(), testULID(4).String()+"  missing-objects  "+path.Join(testULID(4).String(), "chunks", "000001")), "unexpected table output:\n%s", buf.String())
+	testutil.Assert(t, strings.HasSuffix(buf.String(), "4 differences.\n"), "unexpected table output:\n%s", buf.String())
+
+	// Identical buckets do not differ.
+	d, err = diffBuckets(ctx, logger, originBucket, originBucket, filter, diffOptions{})
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, d.count())
+}
+
+func TestDiffBucketsRewrittenMeta(t *testing.T) {
+	ctx := context.Background()
+	logger := testLogger(t.Name())
+	originBucket, targetBucket := inmem.NewBucket(), inmem.NewBucket()
+	opts := diffOptions{injectLabels: labels.FromStrings("test-labelname", "test-labelvalue", "region", "eu"), consistencyDelay: time.Hour}
+
+	// A block replicated with injected labels.
+	meta := testMeta(testULID(0))
+	meta.Thanos.Labels = nil
+
+	b, err := json.Marshal(meta)
+	testutil.Ok(t, err)
+	testutil.Ok(t, originBucket.Upload(ctx, path.Join(testULID(0).String(), "meta.json"), bytes.NewReader(b)))
+	testutil.Ok(t, originBucket.Upload(ctx, path.Join(testULID(0).String(), "index"), bytes.NewReader(nil)))
+
+	rs := newReplicationScheme(logger, newReplicationMetrics(nil), nil, replicationOptions{injectLabels: opts.injectLabels}, nil, nil)
+
+	b, err = rs.targetMetaContent(b)
+	testutil.Ok(t, err)
+	testutil.Ok(t, targetBucket.Upload(ctx, path.Join(testULID(0).String(), "meta.json"), bytes.NewReader(b)))
+	testutil.Ok(t, targetBucket.Upload(ctx, path.Join(testULID(0).String(), "index"), bytes.NewReader(nil)))
+
+	// A block uploaded to the origin too recently to be replicated.
+	fresh := ulid.MustNew(ulid.Now(), nil)
+
+	b, err = json.Marshal(testMeta(fresh))
+	testutil.Ok(t, err)
+	testutil.Ok(t, originBucket.Upload(ctx, path.Join(fresh.String(), "meta.json"), bytes.NewReader(b)))
+
+	filter := testBlockFilter(logger, newReplicationMetrics(nil).blocksFiltered)
+
+	d, err := diffBuckets(ctx, logger, originBucket, targetBucket, filter, opts)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, d.count())
+
+	// Other injected labels differ.
+	opts.injectLabels = labels.FromStrings("test-labelname", "test-labelvalue", "region", "us")
+
+	d, err = diffBuckets(ctx, logger, originBucket, targetBucket, filter, opts)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{testULID(0)}, d.DifferentMeta)
+
+	// Origin blocks without labels are not replicated without the label
+	// flags, so they are not compared.
+	d, err = diffBuckets(ctx, logger, originBucket, targetBucket, filter, diffOptions{consistencyDelay: time.Hour})
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, d.count())
+
+	// Fresh blocks are compared without a consistency delay.
+	d, err = diffBuckets(ctx, logger, originBucket, targetBucket, filter, diffOptions{})
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{fresh}, d.OnlyInOrigin)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+)
+
+// continueOnErrorOptions configures the replication of the remaining blocks
+// once a block failed, instead of skipping the target for the rest of the
+// run.
+type continueOnErrorOptions struct {
+	enabled bool
+	// relaxOrdering lets newer blocks of a group be replicated even though an
+	// older block of the same group failed.
+	relaxOrdering bool
+	// failures counts the consecutive runs every block failed in.
+	failures *blockFailures
+}
+
+// blockFailureKey identifies the replication of a block to a target.
+type blockFailureKey struct {
+	id     ulid.ULID
+	target string
+}
+
+// blockFailures counts the consecutive runs the replication of a block to a
+// target failed in. It outlives replication runs.
+type blockFailures struct {
+	mtx    sync.Mutex
+	counts map[blockFailureKey]int
+}
+
+func newBlockFailures() *blockFailures {
+	return &blockFailures{counts: map[blockFailureKey]int{}}
+}
+
+// update records the blocks that failed in a run. Blocks that did not fail in
+// the run are reset.
+func (f *blockFailures) update(failed map[blockFailureKey]error) map[blockFailureKey]int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	counts := make(map[blockFailureKey]int, len(failed))
+	for k := range failed {
+		counts[k] = f.counts[k] + 1
+	}
+
+	f.counts = counts
+
+	return counts
+}
+
+// failBlock records that a block failed to be replicated to a target in this
+// run, without skipping the target for the remaining blocks.
+func (rs *replicationScheme) failBlock(t *replicationTarget, id ulid.ULID, err error) {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+
+	level.Error(rs.logger).Log("msg", "failed to replicate block, continuing with the remaining blocks", "block_uuid", id.String(), "target", t.name, "err", err)
+	rs.failedBlocks[blockFailureKey{id: id, target: t.name}] = err
+}
+
+// blocksErr returns the errors of all blocks that failed in this run, oldest
+// block first.
+func (rs *replicationScheme) blocksErr() []error {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+
+	errs := make([]error, 0, len(rs.failedBlocks))
+
+	for _, k := range sortedBlockFailureKeys(rs.failedBlocks) {
+		errs = append(errs, fmt.Errorf("replicate block %v to target %v: %w", k.id.String(), k.target, rs.failedBlocks[k]))
+	}
+
+	return errs
+}
+
+// hasFailedBlocks returns whether a block failed to be replicated to the
+// target in this run.
+func (rs *replicationScheme) hasFailedBlocks(t *replicationTarget) bool {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+
+	for k := range rs.failedBlocks {
+		if k.target == t.name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// updateFailedBlocks counts the consecutive failures of the blocks that failed
+// in this run and exposes them.
+func (rs *replicationScheme) updateFailedBlocks() {
+	rs.mtx.Lock()
+	counts := rs.opts.continueOnError.failures.update(rs.failedBlocks)
+	rs.mtx.Unlock()
+
+	rs.metrics.failedBlocks.Reset()
+
+	for k, n := range counts {
+		rs.metrics.failedBlocks.WithLabelValues(k.id.String(), k.target).Set(float64(n))
+	}
+}
+
+// updateBlockedBlocks exposes the number of blocks every target did not
+// replicate as an older block of the same group failed, given the result of
+// the replication of every block.
+func (rs *replicationScheme) updateBlockedBlocks(results map[ulid.ULID]map[string]error) {
+	blocked := make(map[string]int, len(rs.targets))
+	for _, t := range rs.targets {
+		blocked[t.name] = 0
+	}
+
+	for _, errs := range results {
+		for name, err := range errs {
+			if err == errOlderBlockFailed {
+				blocked[name]++
+			}
+		}
+	}
+
+	for name, n := range blocked {
+		rs.metrics.blockedBlocks.WithLabelValues(name).Set(float64(n))
+	}
+}
+
+func sortedBlockFailureKeys(m map[blockFailureKey]error) []blockFailureKey {
+	keys := make([]blockFailureKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if c := keys[i].id.Compare(keys[j].id); c != 0 {
+			return c < 0
+		}
+
+		return keys[i].target < keys[j].target
+	})
+
+	return keys
+}
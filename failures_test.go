@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/tsdb/testutil"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+)
+
+// failingPrefixBucket is a bucket whose uploads of the objects with a prefix,
+// e.g. a block directory, always fail.
+type failingPrefixBucket struct {
+	objstore.Bucket
+
+	prefix string
+}
+
+func (b failingPrefixBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if strings.HasPrefix(name, b.prefix) {
+		return errors.New("upload failed")
+	}
+
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+// countMetrics returns the number of metrics of a collector.
+func countMetrics(c prometheus.Collector) int {
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+
+	return len(ch)
+}
+
+func TestReplicationSchemeContinueOnError(t *testing.T) {
+	ctx := context.Background()
+	logger := testLogger(t.Name())
+	originBucket := inmem.NewBucket()
+
+	// Three blocks of one group and a block of another group.
+	for i := int64(0); i < 4; i++ {
+		meta := testMeta(testULID(i))
+		if i == 3 {
+			meta.Thanos.Labels["other"] = "group"
+		}
+
+		b, err := json.Marshal(meta)
+		testutil.Ok(t, err)
+		testutil.Ok(t, originBucket.Upload(ctx, path.Join(testULID(i).String(), "meta.json"), bytes.NewReader(b)))
+		testutil.Ok(t, originBucket.Upload(ctx, path.Join(testULID(i).String(), "chunks", "000001"), bytes.NewReader([]byte("chunks"))))
+		testutil.Ok(t, originBucket.Upload(ctx, path.Join(testULID(i).String(), "index"), bytes.NewReader([]byte("index"))))
+	}
+
+	filter := testBlockFilter(logger, newReplicationMetrics(nil).blocksFiltered)
+
+	replicated := func(bkt *inmem.Bucket) []int64 {
+		var ids []int64
+
+		for i := int64(0); i < 4; i++ {
+			if _, ok := bkt.Objects()[path.Join(testULID(i).String(), "meta.json")]; ok {
+				ids = append(ids, i)
+			}
+		}
+
+		return ids
+	}
+
+	for _, c := range []struct {
+		name          string
+		relaxOrdering bool
+		replicated    []int64
+		failed        int
+		blocked       float64
+	}{
+		{
+			// Newer blocks of the group of the failed block wait for it
+			// and are blocked rather than failed.
+			name:       "strict ordering",
+			replicated: []int64{3},
+			failed:     1,
+			blocked:    2,
+		},
+		{
+			name:          "relaxed ordering",
+			relaxOrdering: true,
+			replicated:    []int64{1, 2, 3},
+			failed:        1,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			targetBucket := inmem.NewBucket()
+			target := &replicationTarget{name: defaultBucketName, bkt: failingPrefixBucket{Bucket: targetBucket, prefix: testULID(0).String() + "/"}}
+			metrics := newReplicationMetrics(nil)
+			opts := replicationOptions{
+				continueOnError: continueOnErrorOptions{
+					enabled:       true,
+					relaxOrdering: c.relaxOrdering,
+					failures:      newBlockFailures(),
+				},
+			}
+
+			execute := func() error {
+				return newReplicationScheme(logger, metrics, filter, opts, []*replicationOrigin{{name: defaultBucketName, bkt: originBucket}}, []*replicationTarget{target}).execute(ctx)
+			}
+
+			err := execute()
+			testutil.NotOk(t, err)
+			testutil.Assert(t, strings.Contains(err.Error(), "replicate block "+testULID(0).String()), "unexpected error %v", err)
+			testutil.Equals(t, c.replicated, replicated(targetBucket))
+
+			testutil.Equals(t, c.failed, countMetrics(metrics.failedBlocks))
+			testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.failedBlocks.WithLabelValues(testULID(0).String(), defaultBucketName)))
+			testutil.Equals(t, c.blocked, promtestutil.ToFloat64(metrics.blockedBlocks.WithLabelValues(defaultBucketName)))
+			testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.targetBlockFailures.WithLabelValues(defaultBucketName, defaultBucketName)))
+			testutil.Assert(t, !strings.Contains(err.Error(), testULID(1).String()), "blocked block reported as failed: %v", err)
+			testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.targetLastSuccessfulRun.WithLabelValues(defaultBucketName)))
+
+			// Consecutive failures are counted across runs.
+			testutil.NotOk(t, execute())
+			testutil.Equals(t, 2.0, promtestutil.ToFloat64(metrics.failedBlocks.WithLabelValues(testULID(0).String(), defaultBucketName)))
+
+			// Failures are reset once the block is replicated.
+			target.bkt = targetBucket
+			testutil.Ok(t, execute())
+			testutil.Equals(t, []int64{0, 1, 2, 3}, replicated(targetBucket))
+			testutil.Equals(t, 0, countMetrics(metrics.failedBlocks))
+			testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.blockedBlocks.WithLabelValues(defaultBucketName)))
+		})
+	}
+}
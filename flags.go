@@ -2,10 +2,20 @@ package main
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
 	"github.com/thanos-io/thanos/pkg/extflag"
+	"github.com/thanos-io/thanos/pkg/model"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
+	yaml "gopkg.in/yaml.v2"
 )
 
 func regHTTPAddrFlag(cmd *kingpin.CmdClause) *string {
@@ -27,3 +37,145 @@ func regCommonTracingFlags(app *kingpin.Application) *extflag.PathOrContent {
 		false,
 	)
 }
+
+// outputFormat is the format of reports printed by commands.
+type outputFormat string
+
+const (
+	outputFormatTable outputFormat = "table"
+	outputFormatJSON  outputFormat = "json"
+)
+
+// sourceTypes are the sources of blocks accepted by the source filter flags.
+var sourceTypes = []string{
+	string(metadata.SidecarSource),
+	string(metadata.ReceiveSource),
+	string(metadata.CompactorSource),
+	string(metadata.CompactorRepairSource),
+	string(metadata.RulerSource),
+	string(metadata.BucketRepairSource),
+	string(metadata.TestSource),
+}
+
+// blockFilterFlags are the flags selecting the blocks a command works on.
+type blockFilterFlags struct {
+	matchers       *[]string
+	resolution     *string
+	compaction     *string
+	minTime        *model.TimeOrDurationValue
+	maxTime        *model.TimeOrDurationValue
+	timeRangeMode  *string
+	sources        *[]string
+	excludeSources *[]string
+}
+
+// regBlockFilterFlags registers the block filter flags, whose help describes
+// the selected blocks as being acted on as the verb says, e.g. replicated.
+func regBlockFilterFlags(cmd *kingpin.CmdClause, verb string) *blockFilterFlags {
+	return &blockFilterFlags{
+		matchers: cmd.Flag("matcher", fmt.Sprintf("Only blocks whose labels match this matcher will be %s. Accepts PromQL label matchers (=, !=, =~, !~), either a single one or a series selector like {key=~\"value.*\",other!=\"value\"}. All matchers must match.", verb)).PlaceHolder("key=\"value\"").Strings(),
+
+		resolution: cmd.Flag("resolution", fmt.Sprintf("Only blocks with these resolutions will be %s. Accepts a comma separated list of resolutions in milliseconds and inclusive ranges, like 0,300000,3600000.", verb)).Default(strconv.FormatInt(downsample.ResLevel0, 10)).String(),
+		compaction: cmd.Flag("compaction", fmt.Sprintf("Only blocks with these compaction levels will be %s. Accepts a comma separated list of levels and inclusive ranges, like 1-4.", verb)).Default("1").String(),
+
+		minTime: model.TimeOrDuration(cmd.Flag("min-time", fmt.Sprintf("Only blocks within this time range will be %s. Option can be a constant time in RFC3339 format or time duration relative to current time, such as -1d or 2h45m. Valid duration units are ms, s, m, h, d, w, y.", verb)).
+			Default("0000-01-01T00:00:00Z")),
+		maxTime: model.TimeOrDuration(cmd.Flag("max-time", fmt.Sprintf("Only blocks within this time range will be %s. Option can be a constant time in RFC3339 format or time duration relative to current time, such as -1d or 2h45m. Valid duration units are ms, s, m, h, d, w, y.", verb)).
+			Default("9999-12-31T23:59:59Z")),
+		timeRangeMode: cmd.Flag("time-range-mode", "How blocks are matched against --min-time and --max-time. 'overlap' selects blocks overlapping the time range, 'contain' only blocks fully contained in it.").
+			Default(string(timeRangeOverlap)).Enum(string(timeRangeOverlap), string(timeRangeContain)),
+
+		sources:        cmd.Flag("source", fmt.Sprintf("Only blocks uploaded by this source, as recorded in their meta.json, will be %s. One of %s. Repeat to select several sources. All sources are selected if unset.", verb, strings.Join(sourceTypes, ", "))).PlaceHolder("<source>").Enums(sourceTypes...),
+		excludeSources: cmd.Flag("exclude-source", fmt.Sprintf("Blocks uploaded by this source, as recorded in their meta.json, will not be %s. One of %s. Repeat to exclude several sources.", verb, strings.Join(sourceTypes, ", "))).PlaceHolder("<source>").Enums(sourceTypes...),
+	}
+}
+
+// blockFilterConfig is the parsed configuration of a BlockFilter.
+type blockFilterConfig struct {
+	labelSelector    labels.Selector
+	resolutionLevels levelSet
+	compactionLevels levelSet
+	timeRange        timeRange
+	sources          sourceFilter
+}
+
+func (f *blockFilterFlags) parse() (blockFilterConfig, error) {
+	matchers, err := parseFlagMatchers(*f.matchers)
+	if err != nil {
+		return blockFilterConfig{}, errors.Wrap(err, "parse block label matchers")
+	}
+
+	resolutionLevels, err := parseLevelSet(*f.resolution)
+	if err != nil {
+		return blockFilterConfig{}, errors.Wrap(err, "parse resolutions")
+	}
+
+	compactionLevels, err := parseLevelSet(*f.compaction)
+	if err != nil {
+		return blockFilterConfig{}, errors.Wrap(err, "parse compaction levels")
+	}
+
+	return blockFilterConfig{
+		labelSelector:    matchers,
+		resolutionLevels: resolutionLevels,
+		compactionLevels: compactionLevels,
+		timeRange: timeRange{
+			minTime: f.minTime,
+			maxTime: f.maxTime,
+			mode:    timeRangeMode(*f.timeRangeMode),
+		},
+		sources: sourceFilter{
+			include: parseFlagSources(*f.sources),
+			exclude: parseFlagSources(*f.excludeSources),
+		},
+	}, nil
+}
+
+// metaRewriteFlags are the flags changing the external labels of the meta
+// files written to the target bucket.
+type metaRewriteFlags struct {
+	labels        *[]string
+	relabelConfig *extflag.PathOrContent
+}
+
+func regMetaRewriteFlags(cmd *kingpin.CmdClause) *metaRewriteFlags {
+	return &metaRewriteFlags{
+		labels:        cmd.Flag("label", "External label to set in the replicated meta.json of blocks without any external labels, the same way the Thanos shipper does.").PlaceHolder("key=\"value\"").Strings(),
+		relabelConfig: extflag.RegisterPathOrContent(cmd, "relabel-config", "YAML file that contains relabeling configuration applied to the external labels of the meta.json written to the target bucket. Blocks whose labels are all dropped are not replicated. Matchers and other filters apply to the relabeled labels.", false),
+	}
+}
+
+// parse returns the labels injected into blocks without any and the relabel
+// configuration.
+func (f *metaRewriteFlags) parse() (labels.Labels, []*relabel.Config, error) {
+	injectLabels, err := parseFlagLabels(*f.labels)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parse external labels")
+	}
+
+	relabelContentYaml, err := f.relabelConfig.Content()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "get content of relabel configuration")
+	}
+
+	var relabelConfigs []*relabel.Config
+	if err := yaml.Unmarshal(relabelContentYaml, &relabelConfigs); err != nil {
+		return nil, nil, errors.Wrap(err, "parse relabel configuration")
+	}
+
+	return injectLabels, relabelConfigs, nil
+}
+
+// newBlockFilter returns a block filter counting filtered blocks in the
+// filtered metric.
+func (c blockFilterConfig) newBlockFilter(logger log.Logger, filtered *prometheus.CounterVec) *BlockFilter {
+	return NewBlockFilter(
+		logger,
+		filtered,
+		c.labelSelector,
+		c.resolutionLevels,
+		c.compactionLevels,
+		c.timeRange,
+		c.sources,
+	)
+}
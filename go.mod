@@ -4,17 +4,22 @@ go 1.13
 
 require (
 	github.com/go-kit/kit v0.9.0
+	github.com/minio/minio-go/v6 v6.0.39
 	github.com/oklog/run v1.0.0
 	github.com/oklog/ulid v1.3.1
 	github.com/opentracing/opentracing-go v1.1.0
 	github.com/pkg/errors v0.8.1
 	github.com/prometheus/client_golang v1.2.1
+	github.com/prometheus/client_model v0.0.0-20190812154241-14fe0d1b01d4
 	github.com/prometheus/common v0.7.0
 	github.com/prometheus/prometheus v1.8.2-0.20190913102521-8ab628b35467
 	github.com/prometheus/tsdb v0.10.0
 	github.com/thanos-io/thanos v0.8.1-0.20191029132439-b7f3ac9e758d
 	go.uber.org/automaxprocs v1.2.0
+	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
+	google.golang.org/api v0.11.0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v2 v2.2.2
 )
 
 replace k8s.io/client-go => k8s.io/client-go v0.0.0-20190620085101-78d2af792bab
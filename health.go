@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	thanosblock "github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// indexHealthCheckOptions configures the check of the index of origin blocks
+// before they are replicated.
+type indexHealthCheckOptions struct {
+	enabled bool
+	// dir is the directory indexes are downloaded to.
+	dir string
+	// quarantine holds the blocks that failed the check.
+	quarantine *quarantine
+}
+
+var errBlockQuarantined = errors.New("block is quarantined")
+
+// quarantinedBlock is a block that failed the index health check.
+type quarantinedBlock struct {
+	ULID   ulid.ULID `json:"ulid"`
+	Origin string    `json:"origin"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// quarantine is the list of blocks that are not replicated due to a failed
+// index health check. It is persisted to a JSON file, if set, which is
+// reloaded on every run so that operators can clear blocks by removing them
+// from the file.
+type quarantine struct {
+	file string
+
+	mtx    sync.Mutex
+	blocks map[ulid.ULID]quarantinedBlock
+}
+
+func newQuarantine(file string) *quarantine {
+	return &quarantine{
+		file:   file,
+		blocks: map[ulid.ULID]quarantinedBlock{},
+	}
+}
+
+// reload reads the quarantined blocks from the file. A missing file is an
+// empty quarantine.
+func (q *quarantine) reload() error {
+	if q.file == "" {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(q.file)
+	if os.IsNotExist(err) {
+		content = []byte("[]")
+	} else if err != nil {
+		return errors.Wrap(err, "read quarantine file")
+	}
+
+	var blocks []quarantinedBlock
+	if err := json.Unmarshal(content, &blocks); err != nil {
+		return errors.Wrap(err, "parse quarantine file")
+	}
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.blocks = make(map[ulid.ULID]quarantinedBlock, len(blocks))
+	for _, b := range blocks {
+		q.blocks[b.ULID] = b
+	}
+
+	return nil
+}
+
+// add quarantines a block and persists the quarantine.
+func (q *quarantine) add(b quarantinedBlock) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.blocks[b.ULID] = b
+
+	if q.file == "" {
+		return nil
+	}
+
+	content, err := json.MarshalIndent(q.listLocked(), "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal quarantine")
+	}
+
+	// Write to a temporary file first, so that a crash never leaves a
+	// truncated quarantine file behind.
+	tmp := q.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return errors.Wrap(err, "write quarantine file")
+	}
+
+	return errors.Wrap(os.Rename(tmp, q.file), "rename quarantine file")
+}
+
+func (q *quarantine) contains(id ulid.ULID) bool {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	_, ok := q.blocks[id]
+
+	return ok
+}
+
+// list returns the quarantined blocks, oldest first.
+func (q *quarantine) list() []quarantinedBlock {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	return q.listLocked()
+}
+
+func (q *quarantine) listLocked() []quarantinedBlock {
+	blocks := make([]quarantinedBlock, 0, len(q.blocks))
+	for _, b := range q.blocks {
+		blocks = append(blocks, b)
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].ULID.Compare(blocks[j].ULID) < 0
+	})
+
+	return blocks
+}
+
+// updateQuarantineMetric exposes the quarantined blocks.
+func (rs *replicationScheme) updateQuarantineMetric() {
+	rs.metrics.quarantinedBlocks.Reset()
+
+	for _, b := range rs.opts.indexHealthCheck.quarantine.list() {
+		rs.metrics.quarantinedBlocks.WithLabelValues(b.ULID.String(), b.Origin).Set(1)
+	}
+}
+
+// checkIndexHealth downloads the index of an origin block and checks it for
+// critical issues, such as out of order chunks or chunks outside of the block
+// time range. A block failing the check is quarantined, in which case
+// errBlockQuarantined is returned.
+func (rs *replicationScheme) checkIndexHealth(ctx context.Context, origin *replicationOrigin, meta *metadata.Meta) error {
+	id := meta.BlockMeta.ULID
+	blockDir := filepath.Join(rs.opts.indexHealthCheck.dir, id.String())
+
+	if err := os.MkdirAll(blockDir, os.ModePerm); err != nil {
+		return fmt.Errorf("create index directory: %w", err)
+	}
+
+	defer func() {
+		if err := os.RemoveAll(blockDir); err != nil {
+			level.Warn(rs.logger).Log("msg", "failed to remove downloaded index", "block_uuid", id.String(), "err", err)
+		}
+	}()
+
+	indexFile := filepath.Join(blockDir, thanosblock.IndexFilename)
+	if err := rs.downloadObject(ctx, origin, path.Join(id.String(), thanosblock.IndexFilename), indexFile); err != nil {
+		return err
+	}
+
+	stats, err := thanosblock.GatherIndexIssueStats(rs.logger, indexFile, meta.BlockMeta.MinTime, meta.BlockMeta.MaxTime)
+	if err == nil {
+		err = stats.CriticalErr()
+	}
+
+	if err == nil {
+		rs.metrics.indexHealthChecks.WithLabelValues("healthy").Inc()
+		return nil
+	}
+
+	level.Error(rs.logger).Log("msg", "block index is corrupt, quarantining block", "block_uuid", id.String(), "origin", origin.name, "err", err)
+	rs.metrics.indexHealthChecks.WithLabelValues("corrupt").Inc()
+
+	if err := rs.opts.indexHealthCheck.quarantine.add(quarantinedBlock{
+		ULID:   id,
+		Origin: origin.name,
+		Reason: err.Error(),
+		Time:   time.Now(),
+	}); err != nil {
+		return fmt.Errorf("quarantine block: %w", err)
+	}
+
+	rs.updateQuarantineMetric()
+
+	return errBlockQuarantined
+}
+
+// downloadObject copies an object of the origin bucket to a local file,
+// retrying transient errors.
+func (rs *replicationScheme) downloadObject(ctx context.Context, origin *replicationOrigin, objectName, file string) error {
+	return rs.retry(ctx, operationGet, func() error {
+		r, err := origin.bkt.Get(ctx, objectName)
+		if err != nil {
+			return fmt.Errorf("get %v from origin bucket %v: %w", objectName, origin.name, err)
+		}
+
+		defer runutil.CloseWithLogOnErr(rs.logger, r, "close object reader")
+
+		f, err := os.Create(file)
+		if err != nil {
+			return fmt.Errorf("create %v: %w", file, err)
+		}
+
+		defer runutil.CloseWithLogOnErr(rs.logger, f, "close downloaded file")
+
+		cr := &countingReader{r: r}
+		_, err = io.Copy(f, cr)
+		rs.metrics.originBytesRead.WithLabelValues(origin.name).Add(float64(cr.n))
+
+		if err != nil {
+			return fmt.Errorf("download %v: %w", objectName, err)
+		}
+
+		rs.opts.objectSizes.set(objectName, cr.n)
+
+		return nil
+	})
+}
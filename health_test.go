@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	minio "github.com/minio/minio-go/v6"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/tsdb/testutil"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+)
+
+func TestReplicationSchemeIndexHealthCheck(t *testing.T) {
+	ctx := context.Background()
+	logger := testLogger(t.Name())
+	originBucket, targetBucket := inmem.NewBucket(), inmem.NewBucket()
+
+	dir, err := ioutil.TempDir("", "health-test")
+	testutil.Ok(t, err)
+
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	// A block whose meta has a narrower time range than its chunks. It must
+	// not prevent newer blocks of the same group from being replicated.
+	corrupt := testBlock(t, logger, originBucket, dir, 0, 1000)
+	healthy := testBlock(t, logger, originBucket, dir, 1000, 2000)
+
+	meta, err := metadata.Read(filepath.Join(dir, corrupt.String()))
+	testutil.Ok(t, err)
+
+	meta.BlockMeta.MaxTime = 500
+
+	b, err := json.Marshal(meta)
+	testutil.Ok(t, err)
+	testutil.Ok(t, originBucket.Upload(ctx, path.Join(corrupt.String(), "meta.json"), bytes.NewReader(b)))
+
+	metrics := newReplicationMetrics(nil)
+	filter := testBlockFilter(logger, metrics.blocksFiltered)
+
+	quarantineFile := filepath.Join(dir, "quarantine.json")
+	opts := replicationOptions{
+		indexHealthCheck: indexHealthCheckOptions{
+			enabled:    true,
+			dir:        filepath.Join(dir, "index"),
+			quarantine: newQuarantine(quarantineFile),
+		},
+	}
+
+	execute := func() {
+		rs := newReplicationScheme(logger, metrics, filter, opts, []*replicationOrigin{{name: defaultBucketName, bkt: originBucket}}, []*replicationTarget{{name: defaultBucketName, bkt: targetBucket}})
+		testutil.Ok(t, rs.execute(ctx))
+	}
+
+	execute()
+
+	_, ok := targetBucket.Objects()[path.Join(healthy.String(), "meta.json")]
+	testutil.Assert(t, ok, "healthy block not replicated")
+
+	for name := range targetBucket.Objects() {
+		testutil.Assert(t, !strings.HasPrefix(name, corrupt.String()), "object %v of corrupt block replicated", name)
+	}
+
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.indexHealthChecks.WithLabelValues("healthy")))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.indexHealthChecks.WithLabelValues("corrupt")))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.quarantinedBlocks.WithLabelValues(corrupt.String(), defaultBucketName)))
+
+	content, err := ioutil.ReadFile(quarantineFile)
+	testutil.Ok(t, err)
+
+	var quarantined []quarantinedBlock
+	testutil.Ok(t, json.Unmarshal(content, &quarantined))
+	testutil.Equals(t, 1, len(quarantined))
+	testutil.Equals(t, corrupt, quarantined[0].ULID)
+
+	// Quarantined blocks are skipped without being checked again.
+	execute()
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.indexHealthChecks.WithLabelValues("corrupt")))
+
+	// Clearing the quarantine checks the block again.
+	testutil.Ok(t, ioutil.WriteFile(quarantineFile, []byte("[]"), 0644))
+	execute()
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(metrics.indexHealthChecks.WithLabelValues("corrupt")))
+
+	// Already replicated blocks are not checked again on deep reconciles.
+	opts.deepReconcile = true
+	execute()
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.indexHealthChecks.WithLabelValues("healthy")))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.deepReconcileBlocksChecked))
+
+	// Downloaded indexes are removed once checked.
+	files, err := ioutil.ReadDir(filepath.Join(dir, "index"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(files))
+}
+
+func TestReplicationSchemeIndexHealthCheckRetries(t *testing.T) {
+	ctx := context.Background()
+	logger := testLogger(t.Name())
+	originBucket, targetBucket := inmem.NewBucket(), inmem.NewBucket()
+
+	dir, err := ioutil.TempDir("", "health-test")
+	testutil.Ok(t, err)
+
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	id := testBlock(t, logger, originBucket, dir, 0, 1000)
+	indexFile := path.Join(id.String(), "index")
+
+	metrics := newReplicationMetrics(nil)
+	opts := replicationOptions{
+		indexHealthCheck: indexHealthCheckOptions{
+			enabled:    true,
+			dir:        filepath.Join(dir, "index"),
+			quarantine: newQuarantine(""),
+		},
+		retry: retryOptions{attempts: 2, minBackoff: time.Millisecond, maxBackoff: time.Millisecond},
+	}
+
+	// The index download fails once.
+	origin := &flakyBucket{Bucket: originBucket, err: minio.ErrorResponse{Code: "InternalError", StatusCode: http.StatusInternalServerError}, failures: 1, only: indexFile, calls: map[string]int{}}
+
+	rs := newReplicationScheme(logger, metrics, testBlockFilter(logger, metrics.blocksFiltered), opts, []*replicationOrigin{{name: defaultBucketName, bkt: origin}}, []*replicationTarget{{name: defaultBucketName, bkt: targetBucket}})
+	testutil.Ok(t, rs.execute(ctx))
+
+	_, ok := targetBucket.Objects()[path.Join(id.String(), "meta.json")]
+	testutil.Assert(t, ok, "block not replicated")
+
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.indexHealthChecks.WithLabelValues("healthy")))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.operationRetries.WithLabelValues(operationGet)))
+
+	// The index is read once for the check and once more with the chunks to
+	// copy it to the target.
+	objects := originBucket.Objects()
+	testutil.Equals(t, float64(2*len(objects[indexFile])+len(objects[path.Join(id.String(), "chunks", "000001")])), promtestutil.ToFloat64(metrics.originBytesRead.WithLabelValues(defaultBucketName)))
+}
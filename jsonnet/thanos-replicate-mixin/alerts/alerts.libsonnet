@@ -4,6 +4,7 @@
     jobPrefix: error 'must provide job prefix for Thanos Replicate dashboard',
     selector: error 'must provide selector for Thanos Replicate dashboard',
     title: error 'must provide title for Thanos Replicate dashboard',
+    rpoSeconds: error 'must provide recovery point objective for Thanos Replicate alerts',
   },
   prometheusAlerts+:: {
     groups+: [
@@ -57,6 +58,19 @@
               severity: 'critical',
             },
           },
+          {
+            alert: 'ThanosReplicateRPOExceeded',
+            annotations: {
+              message: 'Thanos Replicate {{$labels.job}} has not replicated data to target {{$labels.target}} that is {{ $value | humanizeDuration }} old, exceeding the recovery point objective.',
+            },
+            expr: |||
+              time() - min by (job, target) (thanos_replicate_oldest_pending_block_max_time_seconds{%(selector)s} > 0) > %(rpoSeconds)s
+            ||| % thanos.replicator,
+            'for': '15m',
+            labels: {
+              severity: 'critical',
+            },
+          },
         ],
       },
     ],
@@ -3,6 +3,9 @@
     jobPrefix: 'thanos-replicate',
     selector: 'job=~"%s.*"' % self.jobPrefix,
     title: '%(prefix)sReplicator' % $.dashboard.prefix,
+    // Maximum age of the data not replicated yet, i.e. the recovery point
+    // objective, before alerting.
+    rpoSeconds: 6 * 60 * 60,
   },
   dashboard+:: {
     prefix: 'Thanos / ',
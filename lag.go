@@ -0,0 +1,202 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// objectSizes remembers the size of origin objects read in full, and which
+// of them are known to be present in every target. Object stores do not expose
+// the size of an object without reading it, therefore the size of a block is
+// only known once its objects were read, e.g. by an earlier replication
+// attempt. It outlives replication runs.
+type objectSizes struct {
+	mtx    sync.Mutex
+	blocks map[ulid.ULID]*blockObjects
+}
+
+// blockObjects holds the known object sizes of a block and the objects known
+// to be present in every target.
+type blockObjects struct {
+	sizes    map[string]int64
+	inTarget map[string]map[string]struct{}
+}
+
+func newObjectSizes() *objectSizes {
+	return &objectSizes{blocks: map[ulid.ULID]*blockObjects{}}
+}
+
+// block returns the objects of the block the object belongs to, or nil if the
+// object is outside of a block directory. The mutex must be held.
+func (s *objectSizes) block(objectName string) *blockObjects {
+	id, err := ulid.Parse(strings.SplitN(objectName, objstore.DirDelim, 2)[0])
+	if err != nil {
+		return nil
+	}
+
+	b, ok := s.blocks[id]
+	if !ok {
+		b = &blockObjects{sizes: map[string]int64{}, inTarget: map[string]map[string]struct{}{}}
+		s.blocks[id] = b
+	}
+
+	return b
+}
+
+// set records the size of an object of a block.
+func (s *objectSizes) set(objectName string, size int64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if b := s.block(objectName); b != nil {
+		b.sizes[objectName] = size
+	}
+}
+
+// replicated records that an object of a block is present in a target.
+func (s *objectSizes) replicated(objectName, target string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	b := s.block(objectName)
+	if b == nil {
+		return
+	}
+
+	if _, ok := b.inTarget[target]; !ok {
+		b.inTarget[target] = map[string]struct{}{}
+	}
+
+	b.inTarget[target][objectName] = struct{}{}
+}
+
+// pendingSize returns the total size of the objects of a block known so far
+// that are not known to be present in the target. It is a lower bound of the
+// bytes left to replicate, as objects never read have no known size.
+func (s *objectSizes) pendingSize(id ulid.ULID, target string) int64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	b, ok := s.blocks[id]
+	if !ok {
+		return 0
+	}
+
+	var size int64
+	for name, n := range b.sizes {
+		if _, ok := b.inTarget[target][name]; !ok {
+			size += n
+		}
+	}
+
+	return size
+}
+
+// retain forgets all blocks but the given ones.
+func (s *objectSizes) retain(ids map[ulid.ULID]struct{}) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for id := range s.blocks {
+		if _, ok := ids[id]; !ok {
+			delete(s.blocks, id)
+		}
+	}
+}
+
+// targetLag summarizes how far behind the origins a target is.
+type targetLag struct {
+	pendingBlocks int
+	// pendingBytes is a lower bound of the size of the pending blocks, see
+	// objectSizes.
+	pendingBytes int64
+
+	// oldestPending and oldestPendingMaxTime are the ULID time and the
+	// maximum time of the oldest blocks not replicated yet. They are zero if
+	// no block is pending.
+	oldestPending        time.Time
+	oldestPendingMaxTime time.Time
+
+	// newestReplicated is the maximum time of the newest replicated block,
+	// per external label set.
+	newestReplicated map[string]time.Time
+}
+
+// updateLagMetrics exposes how far behind the origins every target is, given
+// the candidate blocks of the run and the result of their replication to
+// every target. Blocks without a result were not attempted, e.g. because the
+// target failed earlier in the run, and are pending.
+func (rs *replicationScheme) updateLagMetrics(blocks []candidateBlock, results map[ulid.ULID]map[string]error) {
+	lags := make(map[string]*targetLag, len(rs.targets))
+	for _, t := range rs.targets {
+		lags[t.name] = &targetLag{newestReplicated: map[string]time.Time{}}
+	}
+
+	pending := map[ulid.ULID]struct{}{}
+
+	for _, b := range blocks {
+		id := b.meta.BlockMeta.ULID
+		maxTime := timestamp.Time(b.meta.BlockMeta.MaxTime)
+
+		for _, t := range b.targets {
+			lag := lags[t.name]
+			err, ok := results[id][t.name]
+
+			switch {
+			case ok && err == nil:
+				lbls := labels.FromMap(b.meta.Thanos.Labels).String()
+				if maxTime.After(lag.newestReplicated[lbls]) {
+					lag.newestReplicated[lbls] = maxTime
+				}
+			case err == errBlockQuarantined:
+				// Quarantined blocks are exposed separately and not
+				// replicated until cleared.
+			default:
+				pending[id] = struct{}{}
+				lag.pendingBlocks++
+				lag.pendingBytes += rs.opts.objectSizes.pendingSize(id, t.name)
+
+				if created := ulid.Time(id.Time()); lag.oldestPending.IsZero() || created.Before(lag.oldestPending) {
+					lag.oldestPending = created
+				}
+
+				if lag.oldestPendingMaxTime.IsZero() || maxTime.Before(lag.oldestPendingMaxTime) {
+					lag.oldestPendingMaxTime = maxTime
+				}
+			}
+		}
+	}
+
+	// Sizes of replicated blocks are not needed anymore.
+	rs.opts.objectSizes.retain(pending)
+
+	rs.metrics.newestReplicatedMaxTime.Reset()
+
+	for name, lag := range lags {
+		rs.metrics.pendingBlocks.WithLabelValues(name).Set(float64(lag.pendingBlocks))
+		rs.metrics.pendingBytes.WithLabelValues(name).Set(float64(lag.pendingBytes))
+		rs.metrics.oldestPendingBlockTimestamp.WithLabelValues(name).Set(unixSeconds(lag.oldestPending))
+		rs.metrics.oldestPendingBlockMaxTime.WithLabelValues(name).Set(unixSeconds(lag.oldestPendingMaxTime))
+
+		for lbls, maxTime := range lag.newestReplicated {
+			rs.metrics.newestReplicatedMaxTime.WithLabelValues(name, lbls).Set(unixSeconds(maxTime))
+		}
+	}
+}
+
+// unixSeconds returns t as seconds since the Unix epoch, or 0 if t is zero.
+// Timestamps rather than ages are exposed, so that they do not freeze between
+// runs and alerts compute the age at evaluation time.
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return float64(t.UnixNano()) / 1e9
+}
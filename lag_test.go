@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"testing"
+
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+)
+
+func TestReplicationSchemeLagMetrics(t *testing.T) {
+	ctx := context.Background()
+	logger := testLogger(t.Name())
+	originBucket := inmem.NewBucket()
+
+	for i := int64(0); i < 3; i++ {
+		meta := testMeta(testULID(i))
+		meta.BlockMeta.MinTime = i * 1000
+		meta.BlockMeta.MaxTime = (i + 1) * 1000
+
+		b, err := json.Marshal(meta)
+		testutil.Ok(t, err)
+		testutil.Ok(t, originBucket.Upload(ctx, path.Join(testULID(i).String(), "meta.json"), bytes.NewReader(b)))
+		testutil.Ok(t, originBucket.Upload(ctx, path.Join(testULID(i).String(), "chunks", "000001"), bytes.NewReader([]byte("chunks"))))
+		testutil.Ok(t, originBucket.Upload(ctx, path.Join(testULID(i).String(), "index"), bytes.NewReader([]byte("index"))))
+	}
+
+	filter := testBlockFilter(logger, newReplicationMetrics(nil).blocksFiltered)
+
+	// The objects of the newest block are replicated, but not its meta file.
+	// No object of the newest block is replicated to the failing target.
+	targetBucket, failingBucket := inmem.NewBucket(), inmem.NewBucket()
+	target := &replicationTarget{name: defaultBucketName, bkt: failingPrefixBucket{Bucket: targetBucket, prefix: path.Join(testULID(2).String(), "meta.json")}}
+	failing := &replicationTarget{name: "failing", bkt: failingPrefixBucket{Bucket: failingBucket, prefix: testULID(2).String() + "/"}}
+	metrics := newReplicationMetrics(nil)
+	opts := replicationOptions{objectSizes: newObjectSizes()}
+
+	execute := func() error {
+		return newReplicationScheme(logger, metrics, filter, opts, []*replicationOrigin{{name: defaultBucketName, bkt: originBucket}}, []*replicationTarget{target, failing}).execute(ctx)
+	}
+
+	testutil.NotOk(t, execute())
+
+	lbls := labels.FromStrings("test-labelname", "test-labelvalue").String()
+
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.pendingBlocks.WithLabelValues(defaultBucketName)))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.pendingBlocks.WithLabelValues("failing")))
+
+	// Objects already present in the target are not pending, the size of the
+	// meta file is not known.
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.pendingBytes.WithLabelValues(defaultBucketName)))
+	testutil.Equals(t, float64(len("chunks")+len("index")), promtestutil.ToFloat64(metrics.pendingBytes.WithLabelValues("failing")))
+
+	testutil.Equals(t, float64(testULID(2).Time())/1000, promtestutil.ToFloat64(metrics.oldestPendingBlockTimestamp.WithLabelValues(defaultBucketName)))
+	testutil.Equals(t, 3.0, promtestutil.ToFloat64(metrics.oldestPendingBlockMaxTime.WithLabelValues(defaultBucketName)))
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(metrics.newestReplicatedMaxTime.WithLabelValues(defaultBucketName, lbls)))
+
+	// Nothing is pending once all blocks are replicated.
+	target.bkt = targetBucket
+	failing.bkt = failingBucket
+	testutil.Ok(t, execute())
+
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.pendingBlocks.WithLabelValues(defaultBucketName)))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.pendingBytes.WithLabelValues("failing")))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.oldestPendingBlockTimestamp.WithLabelValues(defaultBucketName)))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.oldestPendingBlockMaxTime.WithLabelValues(defaultBucketName)))
+	testutil.Equals(t, 3.0, promtestutil.ToFloat64(metrics.newestReplicatedMaxTime.WithLabelValues(defaultBucketName, lbls)))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// levelRange is an inclusive range of resolution or compaction levels.
+type levelRange struct {
+	min, max int64
+}
+
+// levelSet is a set of non-negative resolution or compaction levels, made of
+// single values and inclusive ranges.
+type levelSet []levelRange
+
+// parseLevelSet parses a comma separated list of values and inclusive ranges,
+// like 0,300000,3600000 or 1-4.
+func parseLevelSet(s string) (levelSet, error) {
+	set := levelSet{}
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			return nil, errors.Errorf("empty value in %q", s)
+		}
+
+		minStr, maxStr := item, item
+		if i := strings.Index(item, "-"); i > 0 {
+			minStr, maxStr = item[:i], item[i+1:]
+		}
+
+		min, err := strconv.ParseInt(strings.TrimSpace(minStr), 10, 64)
+		if err != nil || min < 0 {
+			return nil, errors.Errorf("invalid value %q in %q", item, s)
+		}
+
+		max, err := strconv.ParseInt(strings.TrimSpace(maxStr), 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid value %q in %q", item, s)
+		}
+
+		if min > max {
+			return nil, errors.Errorf("invalid range %q in %q, start is greater than end", item, s)
+		}
+
+		set = append(set, levelRange{min: min, max: max})
+	}
+
+	return set, nil
+}
+
+// contains returns whether the level is part of the set.
+func (s levelSet) contains(level int64) bool {
+	for _, r := range s {
+		if level >= r.min && level <= r.max {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s levelSet) String() string {
+	items := make([]string, 0, len(s))
+
+	for _, r := range s {
+		if r.min == r.max {
+			items = append(items, strconv.FormatInt(r.min, 10))
+			continue
+		}
+
+		items = append(items, strconv.FormatInt(r.min, 10)+"-"+strconv.FormatInt(r.max, 10))
+	}
+
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestParseLevelSet(t *testing.T) {
+	var cases = []struct {
+		name     string
+		input    string
+		expected string
+		err      string
+		contains []int64
+		excludes []int64
+	}{
+		{
+			name:     "Single",
+			input:    "1",
+			expected: "1",
+			contains: []int64{1},
+			excludes: []int64{0, 2},
+		},
+		{
+			name:     "List",
+			input:    "0,300000, 3600000",
+			expected: "0,300000,3600000",
+			contains: []int64{0, 300000, 3600000},
+			excludes: []int64{1, 60000},
+		},
+		{
+			name:     "Range",
+			input:    "1-4",
+			expected: "1-4",
+			contains: []int64{1, 2, 3, 4},
+			excludes: []int64{0, 5},
+		},
+		{
+			name:     "ListAndRange",
+			input:    "1,3-4",
+			expected: "1,3-4",
+			contains: []int64{1, 3, 4},
+			excludes: []int64{2},
+		},
+		{
+			name:  "Empty",
+			input: "",
+			err:   `empty value in ""`,
+		},
+		{
+			name:  "EmptyItem",
+			input: "1,,2",
+			err:   `empty value in "1,,2"`,
+		},
+		{
+			name:  "NotANumber",
+			input: "raw",
+			err:   `invalid value "raw" in "raw"`,
+		},
+		{
+			name:  "Negative",
+			input: "-1",
+			err:   `invalid value "-1" in "-1"`,
+		},
+		{
+			name:  "ReversedRange",
+			input: "4-1",
+			err:   `invalid range "4-1" in "4-1", start is greater than end`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			set, err := parseLevelSet(c.input)
+			if c.err != "" {
+				testutil.NotOk(t, err)
+				testutil.Equals(t, c.err, err.Error())
+
+				return
+			}
+
+			testutil.Ok(t, err)
+			testutil.Equals(t, c.expected, set.String())
+
+			for _, l := range c.contains {
+				testutil.Assert(t, set.contains(l), "set should contain %d", l)
+			}
+
+			for _, l := range c.excludes {
+				testutil.Assert(t, !set.contains(l), "set should not contain %d", l)
+			}
+		})
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -25,6 +26,7 @@ import (
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/version"
 	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/runutil"
 	"github.com/thanos-io/thanos/pkg/tracing/client"
 	"go.uber.org/automaxprocs/maxprocs"
@@ -93,6 +95,8 @@ func main() {
 
 	cmds := map[string]setupFunc{}
 	registerReplicate(cmds, app, "run")
+	registerDiff(cmds, app, "diff")
+	registerVerify(cmds, app, "verify")
 
 	cmd, err := app.Parse(os.Args[1:])
 	if err != nil {
@@ -103,7 +107,7 @@ func main() {
 
 	logger := logger(*logLevel, *logFormat, *debugName)
 	loggerAdapter := func(template string, args ...interface{}) {
-		level.Debug(logger).Log("msg", fmt.Sprintf(template, args))
+		level.Debug(logger).Log("msg", fmt.Sprintf(template, args...))
 	}
 
 	// Running in container with limits but with empty/wrong value of GOMAXPROCS env var could lead to throttling by cpu
@@ -186,6 +190,11 @@ func main() {
 
 	if err := g.Run(); err != nil {
 		level.Error(logger).Log("msg", "running command failed", "err", err)
+
+		if errors.Cause(err) == errBucketsDiffer {
+			os.Exit(exitCodeBucketsDiffer)
+		}
+
 		os.Exit(1)
 	}
 
@@ -244,6 +253,23 @@ func metricHTTPListenGroup(g *run.Group, logger log.Logger, reg prometheus.Gathe
 func parseFlagMatchers(s []string) ([]labels.Matcher, error) {
 	matchers := make([]labels.Matcher, 0, len(s))
 
+	for _, l := range s {
+		m, err := parseSelector(l)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse matcher %q", l)
+		}
+
+		matchers = append(matchers, m...)
+	}
+
+	return matchers, nil
+}
+
+func parseFlagLabels(s []string) (labels.Labels, error) {
+	var lset labels.Labels
+
+	seen := map[string]struct{}{}
+
 	for _, l := range s {
 		parts := strings.SplitN(l, "=", 2)
 		if len(parts) != 2 {
@@ -255,13 +281,31 @@ func parseFlagMatchers(s []string) ([]labels.Matcher, error) {
 			return nil, errors.Errorf("unsupported format for label %s", l)
 		}
 
+		if _, ok := seen[labelName]; ok {
+			return nil, errors.Errorf("duplicate label name %s", labelName)
+		}
+
+		seen[labelName] = struct{}{}
+
 		labelValue, err := strconv.Unquote(parts[1])
 		if err != nil {
 			return nil, errors.Wrap(err, "unquote label value")
 		}
 
-		matchers = append(matchers, labels.NewEqualMatcher(labelName, labelValue))
+		lset = append(lset, labels.Label{Name: labelName, Value: labelValue})
 	}
 
-	return matchers, nil
+	sort.Sort(lset)
+
+	return lset, nil
+}
+
+func parseFlagSources(s []string) []metadata.SourceType {
+	sources := make([]metadata.SourceType, 0, len(s))
+
+	for _, source := range s {
+		sources = append(sources, metadata.SourceType(source))
+	}
+
+	return sources
 }
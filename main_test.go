@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestParseFlagLabels(t *testing.T) {
+	lset, err := parseFlagLabels([]string{`region="eu"`, `cluster="a"`})
+	testutil.Ok(t, err)
+	testutil.Equals(t, labels.FromStrings("cluster", "a", "region", "eu"), lset)
+
+	for _, s := range [][]string{
+		{`region`},
+		{`1region="eu"`},
+		{`region=eu`},
+		{`region="eu"`, `region="us"`},
+	} {
+		_, err := parseFlagLabels(s)
+		testutil.Assert(t, err != nil, "labels %v should be rejected", s)
+	}
+}
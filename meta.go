@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+	promlabels "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// provenanceTool identifies this tool in the meta files it changed.
+const provenanceTool = "thanos-replicate"
+
+// replicatedMeta is the meta file written to the target bucket when the
+// origin meta had to be changed. Thanos components ignore the additional
+// field.
+type replicatedMeta struct {
+	metadata.Meta
+
+	Replication *replicationProvenance `json:"replication,omitempty"`
+}
+
+// replicationProvenance records how a meta file was changed during
+// replication.
+type replicationProvenance struct {
+	// Tool is the tool that changed the meta file.
+	Tool string `json:"tool"`
+	// Time is when the meta file was written to the target bucket. It is
+	// ignored when comparing meta files, see sameMetaContent.
+	Time time.Time `json:"time"`
+	// OriginLabels are the external labels of the block in the origin bucket.
+	OriginLabels map[string]string `json:"originLabels"`
+	// InjectedLabels are the external labels injected into the block, which
+	// had none in the origin bucket, before relabeling.
+	InjectedLabels map[string]string `json:"injectedLabels,omitempty"`
+}
+
+// rewriteMeta applies the configured external label changes to the given
+// meta: labels are injected into blocks without any, then the relabel config
+// is applied. It returns how the meta was changed, or nil if it was not. If
+// the relabel config drops all labels, the meta is left without external
+// labels.
+func (rs *replicationScheme) rewriteMeta(meta *metadata.Meta) *replicationProvenance {
+	return rewriteMeta(meta, rs.opts.injectLabels, rs.opts.relabelConfigs)
+}
+
+func rewriteMeta(meta *metadata.Meta, injectLabels labels.Labels, relabelConfigs []*relabel.Config) *replicationProvenance {
+	originLabels := promlabels.FromMap(meta.Thanos.Labels)
+	lset := originLabels
+
+	var injectedLabels map[string]string
+
+	if len(lset) == 0 && len(injectLabels) > 0 {
+		injectedLabels = injectLabels.Map()
+		lset = promlabels.FromMap(injectedLabels)
+	}
+
+	if len(relabelConfigs) > 0 {
+		lset = relabel.Process(lset, relabelConfigs...)
+	}
+
+	if promlabels.Equal(originLabels, lset) {
+		return nil
+	}
+
+	meta.Thanos.Labels = lset.Map()
+
+	return &replicationProvenance{
+		Tool:           provenanceTool,
+		OriginLabels:   originLabels.Map(),
+		InjectedLabels: injectedLabels,
+	}
+}
+
+// targetMetaContent returns the content of the meta file to write to the
+// target bucket for the given origin meta file content. Unchanged metas are
+// returned as is, so they stay byte for byte equal to the origin.
+func (rs *replicationScheme) targetMetaContent(originContent []byte) ([]byte, error) {
+	var m metadata.Meta
+	if err := json.Unmarshal(originContent, &m); err != nil {
+		return nil, fmt.Errorf("unmarshal meta: %w", err)
+	}
+
+	provenance := rs.rewriteMeta(&m)
+	if provenance == nil {
+		return originContent, nil
+	}
+
+	if len(m.Thanos.Labels) == 0 {
+		return nil, errors.New("all external labels dropped by relabel config")
+	}
+
+	provenance.Time = time.Now().UTC()
+
+	content, err := json.MarshalIndent(replicatedMeta{
+		Meta:        m,
+		Replication: provenance,
+	}, "", "\t")
+	if err != nil {
+		return nil, fmt.Errorf("marshal meta: %w", err)
+	}
+
+	return content, nil
+}
+
+// sameMetaContent returns whether the content of a target meta file is the
+// expected one. The time of rewritten metas is ignored, as it differs
+// between replication runs.
+func sameMetaContent(expected, actual []byte) bool {
+	if bytes.Equal(expected, actual) {
+		return true
+	}
+
+	var e, a replicatedMeta
+	if err := json.Unmarshal(expected, &e); err != nil || e.Replication == nil {
+		return false
+	}
+
+	if err := json.Unmarshal(actual, &a); err != nil || a.Replication == nil {
+		return false
+	}
+
+	e.Replication.Time, a.Replication.Time = time.Time{}, time.Time{}
+
+	return reflect.DeepEqual(e, a)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestSameMetaContent(t *testing.T) {
+	origin := testMeta(testULID(0))
+	origin.Thanos.Labels = nil
+
+	originContent, err := json.Marshal(origin)
+	testutil.Ok(t, err)
+
+	rs := newReplicationScheme(nil, newReplicationMetrics(nil), nil, replicationOptions{injectLabels: labels.FromStrings("region", "eu")}, nil, nil)
+
+	expected, err := rs.targetMetaContent(originContent)
+	testutil.Ok(t, err)
+
+	// Meta files rewritten in an earlier run differ in their time only.
+	time.Sleep(time.Millisecond)
+
+	earlier, err := rs.targetMetaContent(originContent)
+	testutil.Ok(t, err)
+	testutil.Assert(t, string(expected) != string(earlier), "rewritten meta files should record the time")
+	testutil.Assert(t, sameMetaContent(expected, earlier), "meta files differing in their time only should be the same")
+
+	// Different injected labels are not the same.
+	rs.opts.injectLabels = labels.FromStrings("region", "us")
+
+	other, err := rs.targetMetaContent(originContent)
+	testutil.Ok(t, err)
+	testutil.Assert(t, !sameMetaContent(expected, other), "meta files with different labels should not be the same")
+
+	// Unchanged meta files are compared byte for byte.
+	testutil.Assert(t, sameMetaContent(originContent, originContent), "equal meta files should be the same")
+	testutil.Assert(t, !sameMetaContent(originContent, expected), "origin and rewritten meta files should not be the same")
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	thanosblock "github.com/thanos-io/thanos/pkg/block"
+)
+
+// mirrorOptions configures the deletion of target blocks that are no longer
+// present in the origin bucket.
+type mirrorOptions struct {
+	enabled bool
+	// minAge is the minimum time a block has to be missing from the origin
+	// buckets before it is deleted from the target bucket.
+	minAge time.Duration
+	// maxDeletions is the maximum number of blocks deleted per run. 0 means
+	// unlimited.
+	maxDeletions int
+	// maxDeletionRatio is the maximum share of the target blocks missing in
+	// the origin buckets. Above it, nothing is deleted. 1 disables the check.
+	maxDeletionRatio float64
+	// dryRun only reports the blocks that would be deleted.
+	dryRun bool
+	// blockFilter selects the target blocks considered for deletion. Unlike
+	// the block filter of the scheme, it must not count the blocks it filters
+	// out, as they are already counted when scanning the origin buckets.
+	blockFilter blockFilterFunc
+	// state tracks the blocks seen in the origin buckets and since when they
+	// are missing.
+	state *mirrorState
+}
+
+// mirrorState remembers the blocks seen in the origin buckets and, per
+// target, since when the blocks replicated from them are missing in the
+// origin buckets. It outlives replication runs and is persisted to a JSON
+// file, if set, so that it also survives restarts.
+type mirrorState struct {
+	file string
+
+	mtx  sync.Mutex
+	seen map[ulid.ULID]struct{}
+	// missing holds per target the time blocks were first seen missing.
+	missing map[string]map[ulid.ULID]time.Time
+}
+
+// mirrorStateFile is the format of the mirror state file.
+type mirrorStateFile struct {
+	Seen    []ulid.ULID                        `json:"seen"`
+	Missing map[string]map[ulid.ULID]time.Time `json:"missing"`
+}
+
+func newMirrorState(file string) *mirrorState {
+	return &mirrorState{
+		file:    file,
+		seen:    map[ulid.ULID]struct{}{},
+		missing: map[string]map[ulid.ULID]time.Time{},
+	}
+}
+
+// load reads the state from the file. A missing file is an empty state.
+func (s *mirrorState) load() error {
+	if s.file == "" {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("read mirror state file: %w", err)
+	}
+
+	var f mirrorStateFile
+	if err := json.Unmarshal(content, &f); err != nil {
+		return fmt.Errorf("parse mirror state file: %w", err)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.seen = make(map[ulid.ULID]struct{}, len(f.Seen))
+	for _, id := range f.Seen {
+		s.seen[id] = struct{}{}
+	}
+
+	s.missing = map[string]map[ulid.ULID]time.Time{}
+	for target, missing := range f.Missing {
+		s.missing[target] = missing
+	}
+
+	return nil
+}
+
+// save persists the state to the file, if set.
+func (s *mirrorState) save() error {
+	if s.file == "" {
+		return nil
+	}
+
+	s.mtx.Lock()
+
+	f := mirrorStateFile{
+		Seen:    make([]ulid.ULID, 0, len(s.seen)),
+		Missing: s.missing,
+	}
+
+	for id := range s.seen {
+		f.Seen = append(f.Seen, id)
+	}
+
+	sort.Slice(f.Seen, func(i, j int) bool {
+		return f.Seen[i].Compare(f.Seen[j]) < 0
+	})
+
+	content, err := json.MarshalIndent(f, "", "  ")
+	s.mtx.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("marshal mirror state: %w", err)
+	}
+
+	// Write to a temporary file first, so that a crash never leaves a
+	// truncated state file behind.
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return fmt.Errorf("write mirror state file: %w", err)
+	}
+
+	if err := os.Rename(tmp, s.file); err != nil {
+		return fmt.Errorf("rename mirror state file: %w", err)
+	}
+
+	return nil
+}
+
+// observe records the blocks present in the origin buckets.
+func (s *mirrorState) observe(originBlocks map[ulid.ULID]struct{}) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for id := range originBlocks {
+		s.seen[id] = struct{}{}
+	}
+}
+
+func (s *mirrorState) seenInOrigin(id ulid.ULID) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, ok := s.seen[id]
+
+	return ok
+}
+
+// updateMissing records the blocks of the target missing in the origin
+// buckets at the given time and returns since when each of them is missing.
+// Blocks not missing anymore are forgotten.
+func (s *mirrorState) updateMissing(target string, ids []ulid.ULID, now time.Time) map[ulid.ULID]time.Time {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	missing := make(map[ulid.ULID]time.Time, len(ids))
+
+	for _, id := range ids {
+		since, ok := s.missing[target][id]
+		if !ok {
+			since = now
+		}
+
+		missing[id] = since
+	}
+
+	s.missing[target] = missing
+
+	return missing
+}
+
+// deleted forgets a block deleted from the target.
+func (s *mirrorState) deleted(target string, id ulid.ULID) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	delete(s.missing[target], id)
+}
+
+// prune forgets the blocks neither present in the origin buckets nor missing
+// in any target anymore.
+func (s *mirrorState) prune(originBlocks map[ulid.ULID]struct{}) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for id := range s.seen {
+		if _, ok := originBlocks[id]; ok {
+			continue
+		}
+
+		missing := false
+
+		for _, ids := range s.missing {
+			if _, ok := ids[id]; ok {
+				missing = true
+				break
+			}
+		}
+
+		if !missing {
+			delete(s.seen, id)
+		}
+	}
+}
+
+// deleteBlocksMissingInOrigin deletes blocks from the target bucket that are
+// not present in the origin buckets anymore, e.g. because an origin compactor
+// merged them. Only blocks replicated from the origin buckets are considered,
+// i.e. blocks seen in them in an earlier run and selected by the block
+// filter. Blocks produced in the target itself, e.g. by its own compactor, are
+// never present in the origin buckets and are left alone. A block is only
+// deleted if it is a compaction source of another block of the target bucket,
+// so that its data is not lost when the block it was compacted into in the
+// origin is not replicated, e.g. as it is not selected by the block filter.
+// It is deleted once it has been missing for the minimum age, so that blocks
+// briefly missing in an eventually consistent listing are kept.
+func (rs *replicationScheme) deleteBlocksMissingInOrigin(ctx context.Context, t *replicationTarget, originBlocks map[ulid.ULID]struct{}) error {
+	logger := log.With(rs.logger, "target", t.name)
+	state := rs.opts.mirror.state
+
+	targetBlocks := 0
+	missing := []ulid.ULID{}
+	// compactedInto holds the blocks of the target bucket compacted into
+	// another block of it, mapped to that block.
+	compactedInto := map[ulid.ULID]ulid.ULID{}
+
+	if err := t.bkt.Iter(ctx, "", func(name string) error {
+		id, ok := thanosblock.IsBlockDir(name)
+		if !ok {
+			return nil
+		}
+
+		targetBlocks++
+
+		meta, metaNonExistentOrPartial, err := loadMeta(ctx, t.bkt, id)
+		if metaNonExistentOrPartial {
+			// Without a meta file we cannot tell whether this block is ours
+			// to delete.
+			level.Debug(logger).Log("msg", "block has no meta in target bucket. Skipping.", "block_uuid", id.String())
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("load meta for block %v from target bucket: %w", id.String(), err)
+		}
+
+		for _, source := range meta.BlockMeta.Compaction.Sources {
+			if source != id {
+				compactedInto[source] = id
+			}
+		}
+
+		if _, ok := originBlocks[id]; ok {
+			return nil
+		}
+
+		if !state.seenInOrigin(id) {
+			level.Debug(logger).Log("msg", "block missing in origin bucket was never seen in it, e.g. because it was produced in the target bucket. Skipping.", "block_uuid", id.String())
+			return nil
+		}
+
+		if rs.opts.mirror.blockFilter(meta) != "" {
+			return nil
+		}
+
+		missing = append(missing, id)
+
+		return nil
+	}); err != nil {
+		return fmt.Errorf("iterate over target bucket: %w", err)
+	}
+
+	compacted := missing[:0]
+
+	for _, id := range missing {
+		into, ok := compactedInto[id]
+		if !ok {
+			level.Warn(logger).Log("msg", "block missing in origin bucket is not part of any other block in the target bucket, e.g. as the block it was compacted into is not selected by the block filter. Keeping it.", "block_uuid", id.String())
+			continue
+		}
+
+		level.Debug(logger).Log("msg", "block missing in origin bucket was compacted into a block of the target bucket", "block_uuid", id.String(), "target_block_uuid", into.String())
+		compacted = append(compacted, id)
+	}
+
+	missing = compacted
+
+	rs.metrics.mirrorDeletionCandidates.WithLabelValues(t.name).Set(float64(len(missing)))
+
+	if len(missing) == 0 {
+		state.updateMissing(t.name, nil, time.Now())
+		return nil
+	}
+
+	// An empty or much smaller origin is more likely a misconfiguration, e.g.
+	// a wrong prefix, or a wiped origin bucket than blocks compacted away.
+	if len(originBlocks) == 0 {
+		return fmt.Errorf("refusing to delete %d blocks as the origin buckets have no blocks", len(missing))
+	}
+
+	if ratio := float64(len(missing)) / float64(targetBlocks); ratio > rs.opts.mirror.maxDeletionRatio {
+		return fmt.Errorf("refusing to delete %d of %d blocks, more than the max deletion ratio %v", len(missing), targetBlocks, rs.opts.mirror.maxDeletionRatio)
+	}
+
+	now := time.Now()
+	candidates := []ulid.ULID{}
+
+	for id, since := range state.updateMissing(t.name, missing, now) {
+		if now.Sub(since) < rs.opts.mirror.minAge {
+			level.Debug(logger).Log("msg", "block has not been missing in origin bucket long enough to be deleted", "block_uuid", id.String(), "missing_since", since)
+			continue
+		}
+
+		candidates = append(candidates, id)
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// Delete oldest blocks first, they are the most likely to have been
+	// compacted away in the origin.
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Compare(candidates[j]) < 0
+	})
+
+	if rs.opts.mirror.maxDeletions > 0 && len(candidates) > rs.opts.mirror.maxDeletions {
+		level.Warn(logger).Log("msg", "more blocks to delete than allowed per run, deleting only the oldest", "candidates", len(candidates), "max_deletions", rs.opts.mirror.maxDeletions)
+		candidates = candidates[:rs.opts.mirror.maxDeletions]
+	}
+
+	for _, id := range candidates {
+		if rs.opts.mirror.dryRun {
+			level.Info(logger).Log("msg", "dry run: would delete block missing in origin bucket", "block_uuid", id.String())
+			continue
+		}
+
+		// Delete removes the meta file first, so a partially deleted block is
+		// treated as a partial upload by Thanos components.
+		if err := thanosblock.Delete(ctx, logger, t.bkt, id); err != nil {
+			return fmt.Errorf("delete block %v from target bucket: %w", id.String(), err)
+		}
+
+		state.deleted(t.name, id)
+
+		level.Info(logger).Log("msg", "deleted block missing in origin bucket", "block_uuid", id.String())
+		rs.metrics.mirrorBlocksDeleted.WithLabelValues(t.name).Inc()
+	}
+
+	level.Info(logger).Log("msg", "mirrored deletions", "deleted_blocks", len(candidates), "dry_run", rs.opts.mirror.dryRun)
+
+	return nil
+}
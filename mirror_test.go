@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+	"github.com/thanos-io/thanos/pkg/compact"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+)
+
+func TestReplicationSchemeMirror(t *testing.T) {
+	ctx := context.Background()
+	logger := testLogger(t.Name())
+
+	dir, err := ioutil.TempDir("", "mirror-test")
+	testutil.Ok(t, err)
+
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	upload := func(bkt *inmem.Bucket, i int64, sources ...int64) {
+		meta := testMeta(testULID(i))
+
+		// Blocks with sources are compacted from them.
+		for _, source := range sources {
+			meta.BlockMeta.Compaction.Level = 2
+			meta.BlockMeta.Compaction.Sources = append(meta.BlockMeta.Compaction.Sources, testULID(source))
+		}
+
+		b, err := json.Marshal(meta)
+		testutil.Ok(t, err)
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(testULID(i).String(), "meta.json"), bytes.NewReader(b)))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(testULID(i).String(), "chunks", "000001"), bytes.NewReader(nil)))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(testULID(i).String(), "index"), bytes.NewReader(nil)))
+	}
+
+	remove := func(bkt *inmem.Bucket, i int64) {
+		for name := range bkt.Objects() {
+			if strings.HasPrefix(name, testULID(i).String()+"/") {
+				testutil.Ok(t, bkt.Delete(ctx, name))
+			}
+		}
+	}
+
+	present := func(bkt *inmem.Bucket) []int64 {
+		ids := []int64{}
+
+		for _, i := range []int64{0, 1, 2, 3, 5, 10} {
+			if _, ok := bkt.Objects()[path.Join(testULID(i).String(), "meta.json")]; ok {
+				ids = append(ids, i)
+			}
+		}
+
+		return ids
+	}
+
+	for _, c := range []struct {
+		name   string
+		mirror mirrorOptions
+		// removed are the blocks deleted from the origin after the first run.
+		// They are compacted into block 5, which is added to the target, or
+		// to the origin if compactedInOrigin is set.
+		removed           []int64
+		compactedSources  []int64
+		compactedInOrigin bool
+		// compactionLevels selected by the block filter, only the first
+		// level if unset.
+		compactionLevels levelSet
+		// backdate the time blocks were first seen missing before the third
+		// run.
+		backdate bool
+
+		err        string
+		candidates float64
+		// present are the blocks present in the target after the second and
+		// the third run.
+		present      []int64
+		finalPresent []int64
+	}{
+		{
+			name:         "DeletesBlocksMissingInOrigin",
+			removed:      []int64{1, 2},
+			candidates:   2,
+			present:      []int64{0, 3, 5, 10},
+			finalPresent: []int64{0, 3, 5, 10},
+		},
+		{
+			name:              "CompactedInOrigin",
+			removed:           []int64{1, 2},
+			compactedInOrigin: true,
+			compactionLevels:  levelSet{{min: 1, max: 2}},
+			candidates:        2,
+			present:           []int64{0, 3, 5, 10},
+			finalPresent:      []int64{0, 3, 5, 10},
+		},
+		{
+			// The block compacted in the origin is not replicated, therefore
+			// its sources are kept.
+			name:              "CompactedInOriginFiltered",
+			removed:           []int64{1, 2},
+			compactedInOrigin: true,
+			candidates:        0,
+			present:           []int64{0, 1, 2, 3, 10},
+			finalPresent:      []int64{0, 1, 2, 3, 10},
+		},
+		{
+			name:             "NotCompactedInTarget",
+			removed:          []int64{1, 2},
+			compactedSources: []int64{1},
+			candidates:       1,
+			present:          []int64{0, 2, 3, 5, 10},
+			finalPresent:     []int64{0, 2, 3, 5, 10},
+		},
+		{
+			name:         "MinAge",
+			mirror:       mirrorOptions{minAge: time.Hour},
+			removed:      []int64{1, 2},
+			backdate:     true,
+			candidates:   2,
+			present:      []int64{0, 1, 2, 3, 5, 10},
+			finalPresent: []int64{0, 3, 5, 10},
+		},
+		{
+			name:         "MaxDeletions",
+			mirror:       mirrorOptions{maxDeletions: 1},
+			removed:      []int64{1, 2},
+			candidates:   2,
+			present:      []int64{0, 2, 3, 5, 10},
+			finalPresent: []int64{0, 3, 5, 10},
+		},
+		{
+			name:         "DryRun",
+			mirror:       mirrorOptions{dryRun: true},
+			removed:      []int64{1, 2},
+			candidates:   2,
+			present:      []int64{0, 1, 2, 3, 5, 10},
+			finalPresent: []int64{0, 1, 2, 3, 5, 10},
+		},
+		{
+			name:         "MaxDeletionRatio",
+			mirror:       mirrorOptions{maxDeletionRatio: 0.3},
+			removed:      []int64{1, 2},
+			err:          "more than the max deletion ratio",
+			candidates:   2,
+			present:      []int64{0, 1, 2, 3, 5, 10},
+			finalPresent: []int64{0, 1, 2, 3, 5, 10},
+		},
+		{
+			name:         "EmptyOrigin",
+			removed:      []int64{0, 1, 2, 3},
+			err:          "origin buckets have no blocks",
+			candidates:   4,
+			present:      []int64{0, 1, 2, 3, 5, 10},
+			finalPresent: []int64{0, 1, 2, 3, 5, 10},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			originBucket, targetBucket := inmem.NewBucket(), inmem.NewBucket()
+
+			for i := int64(0); i < 4; i++ {
+				upload(originBucket, i)
+			}
+
+			// Block produced in the target, e.g. by its own compactor. It is
+			// never seen in the origin and must be kept.
+			upload(targetBucket, 10)
+
+			stateFile := filepath.Join(dir, c.name+".json")
+			metrics := newReplicationMetrics(nil)
+
+			filter := testBlockFilter(logger, metrics.blocksFiltered)
+			if c.compactionLevels != nil {
+				filter = NewBlockFilter(
+					logger,
+					metrics.blocksFiltered,
+					labels.Selector{labels.NewEqualMatcher("test-labelname", "test-labelvalue")},
+					levelSet{{min: int64(compact.ResolutionLevelRaw), max: int64(compact.ResolutionLevelRaw)}},
+					c.compactionLevels,
+					timeRange{},
+					sourceFilter{},
+				).FilterReason
+			}
+
+			// Every run starts from the persisted state, as after a restart.
+			execute := func(prepare func(*mirrorState)) error {
+				opts := replicationOptions{mirror: c.mirror}
+				opts.mirror.enabled = true
+				opts.mirror.blockFilter = filter
+				opts.mirror.state = newMirrorState(stateFile)
+				testutil.Ok(t, opts.mirror.state.load())
+
+				if prepare != nil {
+					prepare(opts.mirror.state)
+				}
+
+				return newReplicationScheme(logger, metrics, filter, opts, []*replicationOrigin{{name: defaultBucketName, bkt: originBucket}}, []*replicationTarget{{name: defaultBucketName, bkt: targetBucket}}).execute(ctx)
+			}
+
+			testutil.Ok(t, execute(nil))
+			testutil.Equals(t, []int64{0, 1, 2, 3, 10}, present(targetBucket))
+
+			for _, i := range c.removed {
+				remove(originBucket, i)
+			}
+
+			compactedSources := c.compactedSources
+			if compactedSources == nil {
+				compactedSources = c.removed
+			}
+
+			if c.compactedInOrigin {
+				upload(originBucket, 5, compactedSources...)
+			} else {
+				upload(targetBucket, 5, compactedSources...)
+			}
+
+			err := execute(nil)
+			if c.err != "" {
+				testutil.NotOk(t, err)
+				testutil.Assert(t, strings.Contains(err.Error(), c.err), "unexpected error %v", err)
+			} else {
+				testutil.Ok(t, err)
+			}
+
+			testutil.Equals(t, c.present, present(targetBucket))
+			testutil.Equals(t, c.candidates, promtestutil.ToFloat64(metrics.mirrorDeletionCandidates.WithLabelValues(defaultBucketName)))
+
+			_ = execute(func(s *mirrorState) {
+				if !c.backdate {
+					return
+				}
+
+				for id, since := range s.missing[defaultBucketName] {
+					s.missing[defaultBucketName][id] = since.Add(-2 * time.Hour)
+				}
+			})
+
+			testutil.Equals(t, c.finalPresent, present(targetBucket))
+
+			// Blocks replicated in the first run and not present anymore were
+			// deleted.
+			deleted := 4
+			for _, i := range c.finalPresent {
+				if i < 4 {
+					deleted--
+				}
+			}
+
+			testutil.Equals(t, float64(deleted), promtestutil.ToFloat64(metrics.mirrorBlocksDeleted.WithLabelValues(defaultBucketName)))
+		})
+	}
+}
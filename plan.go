@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	thanosblock "github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// Reasons for skipping blocks, reported in the replication plan of a dry run.
+// Blocks not selected by the block filters are reported with the filter
+// reason instead.
+const (
+	skipReasonTooFresh          = "too-fresh"
+	skipReasonPartialMeta       = "partial-meta"
+	skipReasonOriginCollision   = "origin-collision"
+	skipReasonDroppedByRelabel  = "dropped-by-relabel"
+	skipReasonNoExternalLabels  = "no-external-labels"
+	skipReasonCompactedInTarget = "compacted-in-target"
+	skipReasonAlreadyReplicated = "already-replicated"
+	skipReasonQuarantined       = "quarantined"
+)
+
+// replicationPlan describes what a replication run would do, without
+// uploading anything.
+type replicationPlan struct {
+	mtx sync.Mutex
+
+	// Sizes is set if the size of the missing objects was read from the
+	// origin bucket. Otherwise all sizes are omitted.
+	Sizes bool `json:"sizes"`
+
+	Blocks  []plannedBlock `json:"blocks"`
+	Skipped []skippedBlock `json:"skipped"`
+
+	TotalObjects int   `json:"total_objects"`
+	TotalBytes   int64 `json:"total_bytes,omitempty"`
+}
+
+// plannedBlock is a block that would be replicated to a target.
+type plannedBlock struct {
+	ULID       ulid.ULID         `json:"ulid"`
+	Origin     string            `json:"origin"`
+	Target     string            `json:"target"`
+	Labels     map[string]string `json:"labels"`
+	Resolution int64             `json:"resolution"`
+	MinTime    int64             `json:"min_time"`
+	MaxTime    int64             `json:"max_time"`
+
+	MissingObjects []plannedObject `json:"missing_objects"`
+	Bytes          int64           `json:"bytes,omitempty"`
+}
+
+// plannedObject is an object missing in, or mismatching, a target.
+type plannedObject struct {
+	Name string `json:"name"`
+	Size int64  `json:"size,omitempty"`
+}
+
+// skippedBlock is a block that would not be replicated, to a single target if
+// set or to any target otherwise.
+type skippedBlock struct {
+	ULID   ulid.ULID `json:"ulid"`
+	Origin string    `json:"origin,omitempty"`
+	Target string    `json:"target,omitempty"`
+	Reason string    `json:"reason"`
+}
+
+func newReplicationPlan(sizes bool) *replicationPlan {
+	return &replicationPlan{
+		Sizes:   sizes,
+		Blocks:  []plannedBlock{},
+		Skipped: []skippedBlock{},
+	}
+}
+
+func (p *replicationPlan) skip(id ulid.ULID, origin, target, reason string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.Skipped = append(p.Skipped, skippedBlock{ULID: id, Origin: origin, Target: target, Reason: reason})
+}
+
+func (p *replicationPlan) add(origin, target string, meta *metadata.Meta, missing []plannedObject) {
+	b := plannedBlock{
+		ULID:           meta.BlockMeta.ULID,
+		Origin:         origin,
+		Target:         target,
+		Labels:         meta.Thanos.Labels,
+		Resolution:     meta.Thanos.Downsample.Resolution,
+		MinTime:        meta.BlockMeta.MinTime,
+		MaxTime:        meta.BlockMeta.MaxTime,
+		MissingObjects: missing,
+	}
+
+	for _, o := range missing {
+		b.Bytes += o.Size
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.Blocks = append(p.Blocks, b)
+	p.TotalObjects += len(missing)
+	p.TotalBytes += b.Bytes
+}
+
+// write writes the plan in the given format.
+func (p *replicationPlan) write(w io.Writer, format outputFormat) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if format == outputFormatJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(p)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "BLOCK\tORIGIN\tTARGET\tLABELS\tRESOLUTION\tMIN TIME\tMAX TIME\tOBJECTS%s\n", p.column("\tBYTES"))
+
+	for _, b := range p.Blocks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%d%s\n",
+			b.ULID, b.Origin, b.Target, labels.FromMap(b.Labels).String(), b.Resolution,
+			timestamp.Time(b.MinTime).UTC().Format("2006-01-02T15:04:05Z"),
+			timestamp.Time(b.MaxTime).UTC().Format("2006-01-02T15:04:05Z"),
+			len(b.MissingObjects), p.column(fmt.Sprintf("\t%d", b.Bytes)),
+		)
+	}
+
+	fmt.Fprintln(tw)
+	fmt.Fprintf(tw, "TARGET\tMISSING OBJECT%s\n", p.column("\tBYTES"))
+
+	for _, b := range p.Blocks {
+		for _, o := range b.MissingObjects {
+			fmt.Fprintf(tw, "%s\t%s%s\n", b.Target, o.Name, p.column(fmt.Sprintf("\t%d", o.Size)))
+		}
+	}
+
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "SKIPPED BLOCK\tORIGIN\tTARGET\tREASON")
+
+	for _, s := range p.Skipped {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.ULID, s.Origin, s.Target, s.Reason)
+	}
+
+	fmt.Fprintln(tw)
+	if p.Sizes {
+		fmt.Fprintf(tw, "%d blocks to replicate, %d objects, %d bytes in total, %d blocks skipped.\n", len(p.Blocks), p.TotalObjects, p.TotalBytes, len(p.Skipped))
+	} else {
+		fmt.Fprintf(tw, "%d blocks to replicate, %d objects in total, %d blocks skipped.\n", len(p.Blocks), p.TotalObjects, len(p.Skipped))
+	}
+
+	return tw.Flush()
+}
+
+// column returns the given table column if sizes are reported, as they are
+// only known if they were read from the origin bucket.
+func (p *replicationPlan) column(c string) string {
+	if !p.Sizes {
+		return ""
+	}
+
+	return c
+}
+
+// planBlocks records in the plan which objects of the given blocks are missing
+// in their targets, without uploading anything. A target failing to be
+// checked is skipped for the remaining blocks.
+func (rs *replicationScheme) planBlocks(ctx context.Context, blocks []candidateBlock) error {
+	for _, b := range blocks {
+		targets := rs.activeTargets(b.targets)
+		if len(targets) == 0 {
+			continue
+		}
+
+		errs := rs.planBlock(ctx, b.origin, b.meta, targets)
+
+		for _, t := range targets {
+			if err, ok := errs[t.name]; ok {
+				rs.failTarget(t, fmt.Errorf("plan block %v: %w", b.meta.BlockMeta.ULID.String(), err))
+			}
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// planBlock compares a block of the origin bucket with the given targets the
+// same way ensureBlockIsReplicated does and records the missing objects in the
+// plan. The size of missing objects is only read from the origin bucket if
+// sizes are reported. It returns the errors of the targets that could not be
+// checked.
+func (rs *replicationScheme) planBlock(ctx context.Context, origin *replicationOrigin, meta *metadata.Meta, targets []*replicationTarget) map[string]error {
+	id := meta.BlockMeta.ULID
+	metaFile := path.Join(id.String(), thanosblock.MetaFilename)
+
+	errs := map[string]error{}
+
+	expectedMetaFileContent, err := rs.expectedMetaContent(ctx, origin, metaFile)
+	if err != nil {
+		for _, t := range targets {
+			errs[t.name] = err
+		}
+
+		return errs
+	}
+
+	var (
+		pending     []*replicationTarget
+		metaPending = map[string]bool{}
+		missing     = map[string][]plannedObject{}
+	)
+
+	for _, t := range targets {
+		replicated, err := rs.isMetaReplicated(ctx, t, metaFile, expectedMetaFileContent)
+		if err != nil {
+			errs[t.name] = err
+			continue
+		}
+
+		if replicated && !rs.opts.deepReconcile {
+			rs.plan.skip(id, origin.name, t.name, skipReasonAlreadyReplicated)
+			continue
+		}
+
+		metaPending[t.name] = !replicated
+		pending = append(pending, t)
+	}
+
+	if len(pending) == 0 {
+		return errs
+	}
+
+	objectNames, err := rs.listBlockObjects(ctx, origin, id)
+	if err != nil {
+		for _, t := range pending {
+			errs[t.name] = err
+		}
+
+		return errs
+	}
+
+	for _, objectName := range objectNames {
+		originDigest := rs.originDigest(ctx, origin, objectName)
+
+		for _, t := range pending {
+			if _, ok := errs[t.name]; ok {
+				continue
+			}
+
+			replicated, err := rs.isObjectReplicated(ctx, t, objectName, originDigest)
+			if err != nil {
+				errs[t.name] = fmt.Errorf("check object %v: %w", objectName, err)
+				continue
+			}
+
+			if replicated {
+				continue
+			}
+
+			o := plannedObject{Name: objectName}
+
+			if rs.plan.Sizes {
+				d, err := originDigest()
+				if err != nil {
+					errs[t.name] = err
+					continue
+				}
+
+				o.Size = d.size
+			}
+
+			missing[t.name] = append(missing[t.name], o)
+		}
+	}
+
+	for _, t := range pending {
+		if _, ok := errs[t.name]; ok {
+			continue
+		}
+
+		// The meta file is always uploaded last.
+		if metaPending[t.name] {
+			o := plannedObject{Name: metaFile}
+			if rs.plan.Sizes {
+				o.Size = int64(len(expectedMetaFileContent))
+			}
+
+			missing[t.name] = append(missing[t.name], o)
+		}
+
+		if len(missing[t.name]) == 0 {
+			rs.plan.skip(id, origin.name, t.name, skipReasonAlreadyReplicated)
+			continue
+		}
+
+		rs.plan.add(origin.name, t.name, meta, missing[t.name])
+	}
+
+	return errs
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"golang.org/x/time/rate"
+)
+
+// minBytesBurst is the minimum number of bytes a byte rate limiter lets
+// through at once, so that a single read or write of the usual copy buffer
+// size is not split into many waits.
+const minBytesBurst = 32 * 1024
+
+// listPageSize is the number of objects returned by a single listing request
+// of the S3, GCS and Azure clients.
+const listPageSize = 1000
+
+// rateLimits are the limits applied to the buckets of one direction, either
+// all origins or all targets. A limit of 0 disables it.
+type rateLimits struct {
+	bytesPerSecond float64
+	opsPerSecond   float64
+}
+
+// rateLimiter limits the bytes per second and object store operations per
+// second of the buckets of one direction. It is shared by all the buckets of
+// that direction.
+type rateLimiter struct {
+	bytes *rate.Limiter
+	ops   *rate.Limiter
+
+	bytesWaiting   prometheus.Gauge
+	opsWaiting     prometheus.Gauge
+	throttledBytes prometheus.Counter
+	throttledOps   prometheus.Counter
+}
+
+// newRateLimiter returns a rate limiter for the direction, or nil if no
+// limit is set.
+func newRateLimiter(limits rateLimits, metrics *replicationMetrics, direction string) *rateLimiter {
+	if limits.bytesPerSecond <= 0 && limits.opsPerSecond <= 0 {
+		return nil
+	}
+
+	l := &rateLimiter{
+		bytesWaiting:   metrics.rateLimitWaiting.WithLabelValues(direction, "bytes"),
+		opsWaiting:     metrics.rateLimitWaiting.WithLabelValues(direction, "ops"),
+		throttledBytes: metrics.rateLimitThrottled.WithLabelValues(direction, "bytes"),
+		throttledOps:   metrics.rateLimitThrottled.WithLabelValues(direction, "ops"),
+	}
+
+	if limits.bytesPerSecond > 0 {
+		burst := int(limits.bytesPerSecond)
+		if burst < minBytesBurst {
+			burst = minBytesBurst
+		}
+
+		l.bytes = rate.NewLimiter(rate.Limit(limits.bytesPerSecond), burst)
+		metrics.rateLimit.WithLabelValues(direction, "bytes").Set(limits.bytesPerSecond)
+	}
+
+	if limits.opsPerSecond > 0 {
+		burst := int(limits.opsPerSecond)
+		if burst < 1 {
+			burst = 1
+		}
+
+		l.ops = rate.NewLimiter(rate.Limit(limits.opsPerSecond), burst)
+		metrics.rateLimit.WithLabelValues(direction, "ops").Set(limits.opsPerSecond)
+	}
+
+	return l
+}
+
+// waitOp blocks until an object store operation is allowed.
+func (l *rateLimiter) waitOp(ctx context.Context) error {
+	if l.ops == nil {
+		return nil
+	}
+
+	return wait(ctx, l.ops, 1, l.opsWaiting, l.throttledOps)
+}
+
+// waitBytes blocks until n bytes are allowed to be transferred.
+func (l *rateLimiter) waitBytes(ctx context.Context, n int) error {
+	if l.bytes == nil {
+		return nil
+	}
+
+	// WaitN fails on more tokens than the burst, so large transfers wait for
+	// several bursts.
+	for n > 0 {
+		c := n
+		if burst := l.bytes.Burst(); c > burst {
+			c = burst
+		}
+
+		if err := wait(ctx, l.bytes, c, l.bytesWaiting, l.throttledBytes); err != nil {
+			return err
+		}
+
+		n -= c
+	}
+
+	return nil
+}
+
+// wait takes n tokens of the limiter. The waiting gauge counts the calls
+// currently throttled and the throttled counter the total time spent
+// waiting.
+func wait(ctx context.Context, lim *rate.Limiter, n int, waiting prometheus.Gauge, throttled prometheus.Counter) error {
+	if lim.AllowN(time.Now(), n) {
+		return nil
+	}
+
+	waiting.Inc()
+	defer waiting.Dec()
+
+	start := time.Now()
+	defer func() { throttled.Add(time.Since(start).Seconds()) }()
+
+	return lim.WaitN(ctx, n)
+}
+
+// rateLimitedBucket is a bucket whose operations and transferred bytes are
+// limited by a rate limiter.
+type rateLimitedBucket struct {
+	objstore.Bucket
+
+	limiter *rateLimiter
+}
+
+// newRateLimitedBucket returns a bucket limited by the rate limiter, or the
+// bucket itself if the limiter is nil.
+func newRateLimitedBucket(bkt objstore.Bucket, limiter *rateLimiter) objstore.Bucket {
+	if limiter == nil {
+		return bkt
+	}
+
+	return &rateLimitedBucket{Bucket: bkt, limiter: limiter}
+}
+
+// Iter takes an operation for the first listing request, then one more for
+// every listPageSize objects listed, as object store clients paginate
+// listings behind a single Iter call.
+func (b *rateLimitedBucket) Iter(ctx context.Context, dir string, f func(string) error) error {
+	if err := b.limiter.waitOp(ctx); err != nil {
+		return err
+	}
+
+	listed := 0
+
+	return b.Bucket.Iter(ctx, dir, func(name string) error {
+		listed++
+		if listed%listPageSize == 0 {
+			if err := b.limiter.waitOp(ctx); err != nil {
+				return err
+			}
+		}
+
+		return f(name)
+	})
+}
+
+func (b *rateLimitedBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.limiter.waitOp(ctx); err != nil {
+		return nil, err
+	}
+
+	r, err := b.Bucket.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rateLimitedReader{ctx: ctx, r: r, limiter: b.limiter}, nil
+}
+
+func (b *rateLimitedBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if err := b.limiter.waitOp(ctx); err != nil {
+		return nil, err
+	}
+
+	r, err := b.Bucket.GetRange(ctx, name, off, length)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rateLimitedReader{ctx: ctx, r: r, limiter: b.limiter}, nil
+}
+
+func (b *rateLimitedBucket) Exists(ctx context.Context, name string) (bool, error) {
+	if err := b.limiter.waitOp(ctx); err != nil {
+		return false, err
+	}
+
+	return b.Bucket.Exists(ctx, name)
+}
+
+func (b *rateLimitedBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := b.limiter.waitOp(ctx); err != nil {
+		return err
+	}
+
+	return b.Bucket.Upload(ctx, name, &rateLimitedReader{ctx: ctx, r: r, limiter: b.limiter})
+}
+
+func (b *rateLimitedBucket) Delete(ctx context.Context, name string) error {
+	if err := b.limiter.waitOp(ctx); err != nil {
+		return err
+	}
+
+	return b.Bucket.Delete(ctx, name)
+}
+
+// rateLimitedReader limits the bytes per second read from a reader. Bytes are
+// accounted for once read and only returned once the limiter allows them.
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.limiter.waitBytes(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+
+	return n, err
+}
+
+// Close closes the underlying reader, if it is a closer.
+func (r *rateLimitedReader) Close() error {
+	if c, ok := r.r.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
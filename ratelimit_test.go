@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/tsdb/testutil"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+)
+
+func TestRateLimitedBucket(t *testing.T) {
+	ctx := context.Background()
+	metrics := newReplicationMetrics(nil)
+
+	testutil.Assert(t, newRateLimiter(rateLimits{}, metrics, "from") == nil, "limiter created without limits")
+
+	bkt := inmem.NewBucket()
+	limited := newRateLimitedBucket(bkt, newRateLimiter(rateLimits{bytesPerSecond: 2 * minBytesBurst}, metrics, "from"))
+
+	testutil.Equals(t, float64(2*minBytesBurst), promtestutil.ToFloat64(metrics.rateLimit.WithLabelValues("from", "bytes")))
+
+	// Uploading exhausts the initial burst of bytes, so reading the object
+	// back has to wait for a second and a half.
+	content := make([]byte, 3*minBytesBurst)
+	testutil.Ok(t, limited.Upload(ctx, "object", bytes.NewReader(content)))
+
+	start := time.Now()
+
+	r, err := limited.Get(ctx, "object")
+	testutil.Ok(t, err)
+
+	read, err := ioutil.ReadAll(r)
+	testutil.Ok(t, err)
+	testutil.Ok(t, r.Close())
+	testutil.Equals(t, content, read)
+
+	testutil.Assert(t, time.Since(start) >= time.Second, "read not throttled, took %v", time.Since(start))
+	testutil.Assert(t, promtestutil.ToFloat64(metrics.rateLimitThrottled.WithLabelValues("from", "bytes")) > 0, "no throttled bytes recorded")
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.rateLimitWaiting.WithLabelValues("from", "bytes")))
+
+	// Operations beyond the burst of one are throttled.
+	limited = newRateLimitedBucket(bkt, newRateLimiter(rateLimits{opsPerSecond: 1}, metrics, "to"))
+
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.rateLimit.WithLabelValues("to", "ops")))
+
+	for i := 0; i < 2; i++ {
+		_, err := limited.Exists(ctx, "object")
+		testutil.Ok(t, err)
+	}
+
+	testutil.Assert(t, promtestutil.ToFloat64(metrics.rateLimitThrottled.WithLabelValues("to", "ops")) > 0, "no throttled operations recorded")
+
+	// Listings take an operation per page of objects.
+	metrics = newReplicationMetrics(nil)
+	limited = newRateLimitedBucket(bkt, newRateLimiter(rateLimits{opsPerSecond: 1}, metrics, "to"))
+
+	for i := 0; i < listPageSize; i++ {
+		testutil.Ok(t, bkt.Upload(ctx, fmt.Sprintf("dir/%d", i), bytes.NewReader(nil)))
+	}
+
+	listed := 0
+	testutil.Ok(t, limited.Iter(ctx, "dir/", func(string) error {
+		listed++
+		return nil
+	}))
+	testutil.Equals(t, listPageSize, listed)
+	testutil.Assert(t, promtestutil.ToFloat64(metrics.rateLimitThrottled.WithLabelValues("to", "ops")) > 0, "listing pages not throttled")
+
+	// Canceled calls return without waiting.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	_, err = limited.Exists(cancelCtx, "object")
+	testutil.NotOk(t, err)
+}
@@ -3,8 +3,9 @@ package main
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
-	"strconv"
+	"os"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -14,10 +15,8 @@ import (
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/prometheus/tsdb/labels"
-	"github.com/thanos-io/thanos/pkg/compact"
-	"github.com/thanos-io/thanos/pkg/compact/downsample"
 	"github.com/thanos-io/thanos/pkg/extflag"
+	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/objstore/client"
 	"github.com/thanos-io/thanos/pkg/runutil"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
@@ -25,8 +24,7 @@ import (
 
 const replicateComponent = "replicate"
 
-// TODO(bwplotka): Consider moving to Thanos. Consider adding --labels to add to meta.json if empty to match shipper
-// logic: https://github.com/observatorium/thanos-replicate/issues/7.
+// TODO(bwplotka): Consider moving to Thanos.
 func registerReplicate(m map[string]setupFunc, app *kingpin.Application, name string) {
 	cmd := app.Command(name, "Runs replication as a long running daemon.")
 
@@ -34,19 +32,121 @@ func registerReplicate(m map[string]setupFunc, app *kingpin.Application, name st
 
 	// TODO(bwplotka): Add support for local filesystem bucket implementation.
 	fromObjStoreConfig := regCommonObjStoreFlags(cmd, "from", false)
+	originsConfig := extflag.RegisterPathOrContent(cmd, "origins.config", "YAML file that contains a list of named object store configurations to replicate from, instead of a single one. Blocks with the same ID but a different meta.json in several origins are reported and not replicated. Entries have the format of an object store configuration with an additional unique name field. See format details: https://thanos.io/storage.md/#configuration", false)
+	fromPrefix := cmd.Flag("from.prefix", "Directory of the origin buckets the blocks are stored in, e.g. thanos/prod. Named origins can set their own prefix.").Default("").String()
 	toObjStoreConfig := regCommonObjStoreFlags(cmd, "to", false)
+	targetsConfig := extflag.RegisterPathOrContent(cmd, "targets.config", "YAML file that contains a list of named object store configurations to replicate to, instead of a single one. Each block is read once from the origin bucket and written to all targets. Entries have the format of an object store configuration with an additional unique name field. See format details: https://thanos.io/storage.md/#configuration", false)
+	toPrefix := cmd.Flag("to.prefix", "Directory of the target buckets the blocks are replicated to, e.g. thanos/dr. Named targets can set their own prefix.").Default("").String()
 
-	matcherStrs := cmd.Flag("matcher", "Only blocks whose labels match this matcher will be replicated.").PlaceHolder("key=\"value\"").Strings()
+	fromBytesPerSecond := cmd.Flag("from.rate-limit.bytes-per-second", "Maximum bytes per second read from all origin buckets together. 0 disables the limit.").Default("0").Float64()
+	fromOpsPerSecond := cmd.Flag("from.rate-limit.ops-per-second", "Maximum object store operations, such as listing, Exists and Get calls, per second on all origin buckets together. Listings count one operation per page of 1000 objects. 0 disables the limit.").Default("0").Float64()
+	toBytesPerSecond := cmd.Flag("to.rate-limit.bytes-per-second", "Maximum bytes per second transferred to and from all target buckets together. Includes uploads as well as objects read back from the targets, e.g. to verify them with --object-verification. 0 disables the limit.").Default("0").Float64()
+	toOpsPerSecond := cmd.Flag("to.rate-limit.ops-per-second", "Maximum object store operations, such as listing, Exists, Get and Upload calls, per second on all target buckets together. Listings count one operation per page of 1000 objects. 0 disables the limit.").Default("0").Float64()
 
-	resolution := cmd.Flag("resolution", "Only blocks with this resolution will be replicated.").Default(strconv.FormatInt(downsample.ResLevel0, 10)).Int64()
-	compaction := cmd.Flag("compaction", "Only blocks with this compaction level will be replicated.").Default("1").Int()
+	filterFlags := regBlockFilterFlags(cmd, "replicated")
+
+	metaRewriteFlags := regMetaRewriteFlags(cmd)
+
+	blockConcurrency := cmd.Flag("block-concurrency", "Number of blocks replicated in parallel. Meta files are still uploaded oldest block first within each group of blocks sharing external labels and resolution.").Default("1").Int()
+	objectConcurrency := cmd.Flag("object-concurrency", "Number of objects (chunk segments and index) replicated in parallel within a single block. The meta file is always uploaded last.").Default("1").Int()
+
+	verification := cmd.Flag("object-verification", "How objects already present in the target bucket are verified before being considered replicated. 'exists' only checks their presence, 'size' compares their size with the origin, 'hash' additionally compares their SHA-256. Object stores do not expose the size of an object without reading it, so 'size' and 'hash' both download every existing object from the origin and the target bucket and cost the same egress; 'size' only saves the CPU of hashing. Objects failing verification are replicated again.").
+		Default(string(objectVerificationExists)).Enum(string(objectVerificationExists), string(objectVerificationSize), string(objectVerificationHash))
+
+	deepReconcileInterval := cmd.Flag("deep-reconcile.interval", "Interval after which a replication run checks every object of already replicated blocks instead of trusting their meta file, repairing missing ones. The first run after a start is a deep reconcile too, as the time of the last one is not persisted. 0 disables the time based schedule.").Default("0s").Duration()
+	deepReconcileEveryRuns := cmd.Flag("deep-reconcile.every-runs", "Number of replication runs after which a run checks every object of already replicated blocks instead of trusting their meta file, repairing missing ones. 0 disables the run based schedule.").Default("0").Int()
+
+	consistencyDelay := cmd.Flag("consistency-delay", "Minimum age of origin blocks, based on their ULID, before they are replicated. Gives eventually consistent object stores time to expose complete blocks and origin compactors time to delete the blocks they compacted.").Default("0s").Duration()
+
+	skipCompactedInTarget := cmd.Flag("skip-compacted-in-target", "Read the metas of all target blocks and skip origin blocks that are already a compaction source of a target block with the same external labels and resolution. Avoids overlaps when the target runs its own compactor.").Default("false").Bool()
+
+	indexHealthCheck := cmd.Flag("index-health-check", "Download the index of origin blocks before replicating them and check it for critical issues, such as out of order chunks or chunks outside of the block time range. Corrupt blocks are quarantined and not replicated.").Default("false").Bool()
+	indexHealthCheckDir := cmd.Flag("index-health-check.dir", "Directory indexes are downloaded to for the index health check. A temporary directory is used if unset.").Default("").String()
+	quarantineFile := cmd.Flag("index-health-check.quarantine-file", "JSON file the blocks failing the index health check are recorded in. Quarantined blocks are skipped until removed from the file. Quarantined blocks are only kept in memory if unset.").Default("").String()
+
+	retryAttempts := cmd.Flag("retry.attempts", "Maximum number of attempts of a single Get, Upload or Exists object store call failing with a transient error, such as a timeout, a server error or throttling. Permanent errors are not retried. 1 disables retries.").Default("3").Int()
+	retryMinBackoff := cmd.Flag("retry.min-backoff", "Backoff before the first retry of an object store call, doubled for every following retry, with a random jitter.").Default("1s").Duration()
+	retryMaxBackoff := cmd.Flag("retry.max-backoff", "Maximum backoff between retries of an object store call.").Default("30s").Duration()
+
+	continueOnError := cmd.Flag("continue-on-error", "Keep replicating the remaining blocks to a target once a block failed, instead of skipping the target for the rest of the run. Failed blocks are retried in the next run and the run fails once all blocks were attempted. Newer blocks of the same group as a failed block are still not replicated unless --continue-on-error.relax-ordering is set.").Default("false").Bool()
+	relaxOrdering := cmd.Flag("continue-on-error.relax-ordering", "In continue on error mode, replicate newer blocks of a group even though an older block of the same group failed. Targets may then receive the blocks of a group out of order.").Default("false").Bool()
+
+	mirror := cmd.Flag("mirror", "Delete blocks selected by the block filters from the target bucket once they are no longer present in the origin bucket, e.g. after being compacted. Only blocks seen in the origin bucket before are deleted, so blocks produced in the target bucket, e.g. by its own compactor, are kept. Blocks are only deleted once compacted into another block present in the target bucket, therefore blocks whose compacted block is not replicated, e.g. as its compaction level is not selected by --compaction, are kept.").Default("false").Bool()
+	mirrorMinAge := cmd.Flag("mirror.min-age", "Minimum time a block has to be missing from the origin bucket before it is deleted from the target bucket in mirror mode. Protects against blocks briefly missing from eventually consistent listings.").Default("24h").Duration()
+	mirrorMaxDeletionRatio := cmd.Flag("mirror.max-deletion-ratio", "Maximum share of the target blocks missing in the origin bucket in mirror mode. Above it, or if the origin bucket has no blocks at all, nothing is deleted and the run fails, as the origin bucket is more likely misconfigured or wiped. 1 disables the check.").Default("0.5").Float64()
+	mirrorStateFile := cmd.Flag("mirror.state-file", "JSON file the blocks seen in the origin bucket and since when they are missing are recorded in for mirror mode. Only kept in memory if unset, in which case blocks are only deleted once seen missing for the minimum age by a single process, never with --single-run.").Default("").String()
+	mirrorMaxDeletions := cmd.Flag("mirror.max-deletions", "Maximum number of blocks deleted from the target bucket per run in mirror mode. 0 means unlimited.").Default("10").Int()
+	mirrorDryRun := cmd.Flag("mirror.dry-run", "Only log the blocks that would be deleted from the target bucket in mirror mode.").Default("false").Bool()
 
 	singleRun := cmd.Flag("single-run", "Run replication only one time, then exit.").Default("false").Bool()
+	dryRun := cmd.Flag("dry-run", "Scan the origin and target buckets without uploading or deleting anything, then print the plan of blocks to replicate, skipped blocks with reasons and missing objects. Requires --single-run.").Default("false").Bool()
+	dryRunSizes := cmd.Flag("dry-run.sizes", "Read the objects missing in the target buckets from the origin bucket to report their size in the dry run plan. Without it, only the number of missing objects is reported.").Default("false").Bool()
+	dryRunFormat := cmd.Flag("dry-run.format", "Output format of the dry run plan.").
+		Default(string(outputFormatTable)).Enum(string(outputFormatTable), string(outputFormatJSON))
 
 	m[name] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, _ bool) error {
-		matchers, err := parseFlagMatchers(*matcherStrs)
+		filterConf, err := filterFlags.parse()
+		if err != nil {
+			return err
+		}
+
+		injectLabels, relabelConfigs, err := metaRewriteFlags.parse()
 		if err != nil {
-			return errors.Wrap(err, "parse block label matchers")
+			return err
+		}
+
+		if *blockConcurrency < 1 {
+			return errors.Errorf("block concurrency must be at least 1, got %d", *blockConcurrency)
+		}
+
+		if *objectConcurrency < 1 {
+			return errors.Errorf("object concurrency must be at least 1, got %d", *objectConcurrency)
+		}
+
+		if *mirrorMaxDeletions < 0 {
+			return errors.Errorf("mirror max deletions must not be negative, got %d", *mirrorMaxDeletions)
+		}
+
+		if *mirrorMaxDeletionRatio <= 0 || *mirrorMaxDeletionRatio > 1 {
+			return errors.Errorf("mirror max deletion ratio must be in (0, 1], got %v", *mirrorMaxDeletionRatio)
+		}
+
+		mirrorState := newMirrorState(*mirrorStateFile)
+		if *mirror {
+			if err := mirrorState.load(); err != nil {
+				return err
+			}
+		}
+
+		if *deepReconcileEveryRuns < 0 {
+			return errors.Errorf("deep reconcile every runs must not be negative, got %d", *deepReconcileEveryRuns)
+		}
+
+		for name, limit := range map[string]float64{
+			"from.rate-limit.bytes-per-second": *fromBytesPerSecond,
+			"from.rate-limit.ops-per-second":   *fromOpsPerSecond,
+			"to.rate-limit.bytes-per-second":   *toBytesPerSecond,
+			"to.rate-limit.ops-per-second":     *toOpsPerSecond,
+		} {
+			if limit < 0 {
+				return errors.Errorf("%s must not be negative, got %v", name, limit)
+			}
+		}
+
+		if *retryAttempts < 1 {
+			return errors.Errorf("retry attempts must be at least 1, got %d", *retryAttempts)
+		}
+
+		if *retryMinBackoff > *retryMaxBackoff {
+			return errors.Errorf("retry min backoff %v must not be greater than max backoff %v", *retryMinBackoff, *retryMaxBackoff)
+		}
+
+		if *relaxOrdering && !*continueOnError {
+			return errors.New("relaxed ordering requires --continue-on-error")
+		}
+
+		if *dryRun && !*singleRun {
+			return errors.New("dry run requires --single-run")
 		}
 
 		return runReplicate(
@@ -55,12 +155,53 @@ func registerReplicate(m map[string]setupFunc, app *kingpin.Application, name st
 			reg,
 			tracer,
 			*httpMetricsBindAddr,
-			matchers,
-			compact.ResolutionLevel(*resolution),
-			*compaction,
+			filterConf,
+			replicationOptions{
+				blockConcurrency:      *blockConcurrency,
+				objectConcurrency:     *objectConcurrency,
+				objectVerification:    objectVerification(*verification),
+				consistencyDelay:      *consistencyDelay,
+				skipCompactedInTarget: *skipCompactedInTarget,
+				injectLabels:          injectLabels,
+				relabelConfigs:        relabelConfigs,
+				dryRun:                *dryRun,
+				dryRunSizes:           *dryRunSizes,
+				retry: retryOptions{
+					attempts:   *retryAttempts,
+					minBackoff: *retryMinBackoff,
+					maxBackoff: *retryMaxBackoff,
+				},
+				indexHealthCheck: indexHealthCheckOptions{
+					enabled:    *indexHealthCheck,
+					dir:        *indexHealthCheckDir,
+					quarantine: newQuarantine(*quarantineFile),
+				},
+				continueOnError: continueOnErrorOptions{
+					enabled:       *continueOnError,
+					relaxOrdering: *relaxOrdering,
+					failures:      newBlockFailures(),
+				},
+				objectSizes: newObjectSizes(),
+				mirror: mirrorOptions{
+					enabled:          *mirror,
+					minAge:           *mirrorMinAge,
+					maxDeletions:     *mirrorMaxDeletions,
+					maxDeletionRatio: *mirrorMaxDeletionRatio,
+					dryRun:           *mirrorDryRun,
+					state:            mirrorState,
+				},
+			},
+			newDeepReconcileSchedule(*deepReconcileInterval, *deepReconcileEveryRuns),
 			fromObjStoreConfig,
+			originsConfig,
+			*fromPrefix,
+			rateLimits{bytesPerSecond: *fromBytesPerSecond, opsPerSecond: *fromOpsPerSecond},
 			toObjStoreConfig,
+			targetsConfig,
+			*toPrefix,
+			rateLimits{bytesPerSecond: *toBytesPerSecond, opsPerSecond: *toOpsPerSecond},
 			*singleRun,
+			outputFormat(*dryRunFormat),
 		)
 	}
 }
@@ -71,12 +212,19 @@ func runReplicate(
 	reg *prometheus.Registry,
 	_ opentracing.Tracer,
 	httpMetricsBindAddr string,
-	labelSelector labels.Selector,
-	resolution compact.ResolutionLevel,
-	compaction int,
+	filterConf blockFilterConfig,
+	opts replicationOptions,
+	deepReconcile *deepReconcileSchedule,
 	fromObjStoreConfig *extflag.PathOrContent,
+	originsConfig *extflag.PathOrContent,
+	fromPrefix string,
+	fromLimits rateLimits,
 	toObjStoreConfig *extflag.PathOrContent,
+	targetsConfig *extflag.PathOrContent,
+	toPrefix string,
+	toLimits rateLimits,
 	singleRun bool,
+	dryRunFormat outputFormat,
 ) error {
 	logger = log.With(logger, "component", "replicate")
 
@@ -86,42 +234,87 @@ func runReplicate(
 		return err
 	}
 
+	metrics := newReplicationMetrics(reg)
+
 	fromConfContentYaml, err := fromObjStoreConfig.Content()
 	if err != nil {
 		return err
 	}
 
-	if len(fromConfContentYaml) == 0 {
+	originsConfContentYaml, err := originsConfig.Content()
+	if err != nil {
+		return err
+	}
+
+	originConfs, err := bucketConfigs(fromConfContentYaml, originsConfContentYaml, fromPrefix)
+	if err != nil {
+		return errors.Wrap(err, "origins configuration")
+	}
+
+	if len(originConfs) == 0 {
 		return errors.New("No supported bucket was configured to replicate from")
 	}
 
-	fromBkt, err := client.NewBucket(
-		logger,
-		fromConfContentYaml,
-		prometheus.WrapRegistererWith(prometheus.Labels{"replicate": "from"}, reg),
-		replicateComponent,
-	)
+	// All origins share a single rate limiter, the same goes for targets.
+	originLimiter := newRateLimiter(fromLimits, metrics, "from")
+	origins := make([]*replicationOrigin, 0, len(originConfs))
+	// The origins only need read access, their clients are closed through
+	// originBkts.
+	originBkts := make([]objstore.Bucket, 0, len(originConfs))
+
+	for _, conf := range originConfs {
+		bkt, err := client.NewBucket(
+			logger,
+			conf.content,
+			prometheus.WrapRegistererWith(prometheus.Labels{"replicate": "from", "replicate_bucket": conf.name}, reg),
+			replicateComponent,
+		)
+		if err != nil {
+			return errors.Wrapf(err, "create origin bucket %s", conf.name)
+		}
+
+		bkt = newRateLimitedBucket(newPrefixedBucket(bkt, conf.prefix), originLimiter)
+
+		origins = append(origins, &replicationOrigin{name: conf.name, bkt: bkt})
+		originBkts = append(originBkts, bkt)
+	}
+
+	toConfContentYaml, err := toObjStoreConfig.Content()
 	if err != nil {
 		return err
 	}
 
-	toConfContentYaml, err := toObjStoreConfig.Content()
+	targetsConfContentYaml, err := targetsConfig.Content()
 	if err != nil {
 		return err
 	}
 
-	if len(toConfContentYaml) == 0 {
+	targetConfs, err := bucketConfigs(toConfContentYaml, targetsConfContentYaml, toPrefix)
+	if err != nil {
+		return errors.Wrap(err, "targets configuration")
+	}
+
+	if len(targetConfs) == 0 {
 		return errors.New("No supported bucket was configured to replicate to")
 	}
 
-	toBkt, err := client.NewBucket(
-		logger,
-		toConfContentYaml,
-		prometheus.WrapRegistererWith(prometheus.Labels{"replicate": "to"}, reg),
-		replicateComponent,
-	)
-	if err != nil {
-		return err
+	targetLimiter := newRateLimiter(toLimits, metrics, "to")
+	targets := make([]*replicationTarget, 0, len(targetConfs))
+
+	for _, conf := range targetConfs {
+		bkt, err := client.NewBucket(
+			logger,
+			conf.content,
+			prometheus.WrapRegistererWith(prometheus.Labels{"replicate": "to", "replicate_bucket": conf.name}, reg),
+			replicateComponent,
+		)
+		if err != nil {
+			return errors.Wrapf(err, "create target bucket %s", conf.name)
+		}
+
+		bkt = newRateLimitedBucket(newPrefixedBucket(bkt, conf.prefix), targetLimiter)
+
+		targets = append(targets, &replicationTarget{name: conf.name, bkt: bkt})
 	}
 
 	replicationRunCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
@@ -137,13 +330,21 @@ func runReplicate(
 	reg.MustRegister(replicationRunCounter)
 	reg.MustRegister(replicationRunDuration)
 
-	blockFilter := NewBlockFilter(
-		logger,
-		labelSelector,
-		resolution,
-		compaction,
-	).Filter
-	metrics := newReplicationMetrics(reg)
+	// tmpDir is removed on exit, unlike directories set by flags.
+	var tmpDir string
+
+	if opts.indexHealthCheck.enabled && opts.indexHealthCheck.dir == "" {
+		tmpDir, err = ioutil.TempDir("", "thanos-replicate-index")
+		if err != nil {
+			return errors.Wrap(err, "create index health check directory")
+		}
+
+		opts.indexHealthCheck.dir = tmpDir
+	}
+
+	blockFilter := filterConf.newBlockFilter(logger, metrics.blocksFiltered).FilterReason
+	// Target blocks filtered out in mirror mode are not counted.
+	opts.mirror.blockFilter = filterConf.newBlockFilter(logger, newReplicationMetrics(nil).blocksFiltered).FilterReason
 	ctx, cancel := context.WithCancel(context.Background())
 
 	replicateFn := func() error {
@@ -158,16 +359,40 @@ func runReplicate(
 		logger := log.With(logger, "replication-run-id", ulid.String())
 		level.Info(logger).Log("msg", "running replication attempt")
 
-		if err := newReplicationScheme(logger, metrics, blockFilter, fromBkt, toBkt).execute(ctx); err != nil {
+		runOpts := opts
+		runOpts.deepReconcile = deepReconcile.due(timestamp)
+
+		rs := newReplicationScheme(logger, metrics, blockFilter, runOpts, origins, targets)
+		err = rs.execute(ctx)
+		deepReconcile.completed(timestamp, runOpts.deepReconcile && err == nil)
+
+		if err != nil {
 			return fmt.Errorf("replication execute: %w", err)
 		}
 
+		if rs.plan != nil {
+			return errors.Wrap(rs.plan.write(os.Stdout, dryRunFormat), "write dry run plan")
+		}
+
 		return nil
 	}
 
 	g.Add(func() error {
-		defer runutil.CloseWithLogOnErr(logger, fromBkt, "from bucket client")
-		defer runutil.CloseWithLogOnErr(logger, toBkt, "to bucket client")
+		for i, bkt := range originBkts {
+			defer runutil.CloseWithLogOnErr(logger, bkt, "from bucket client %s", origins[i].name)
+		}
+
+		for _, t := range targets {
+			defer runutil.CloseWithLogOnErr(logger, t.bkt, "to bucket client %s", t.name)
+		}
+
+		if tmpDir != "" {
+			defer func() {
+				if err := os.RemoveAll(tmpDir); err != nil {
+					level.Warn(logger).Log("msg", "failed to remove temporary directory", "dir", tmpDir, "err", err)
+				}
+			}()
+		}
 
 		if singleRun {
 			return replicateFn()
@@ -197,3 +422,47 @@ func runReplicate(
 
 	return nil
 }
+
+// deepReconcileSchedule decides which replication runs ignore the meta file
+// shortcut and check every object of already replicated blocks.
+type deepReconcileSchedule struct {
+	interval  time.Duration
+	everyRuns int
+
+	// runs is the number of runs since the last successful deep reconcile.
+	runs int
+	// last is the start of the last successful deep reconcile. It is zero
+	// until then, so that the first run of a process deep reconciles if the
+	// interval is set. Otherwise a process restarted more often than the
+	// interval, e.g. on every deploy or with --single-run, never would.
+	last time.Time
+}
+
+func newDeepReconcileSchedule(interval time.Duration, everyRuns int) *deepReconcileSchedule {
+	return &deepReconcileSchedule{
+		interval:  interval,
+		everyRuns: everyRuns,
+	}
+}
+
+// due returns whether a run starting at the given time should be a deep
+// reconcile.
+func (s *deepReconcileSchedule) due(now time.Time) bool {
+	if s.everyRuns > 0 && s.runs+1 >= s.everyRuns {
+		return true
+	}
+
+	return s.interval > 0 && now.Sub(s.last) >= s.interval
+}
+
+// completed records a finished run. A failed deep reconcile is not recorded as
+// such, so that the next run attempts it again.
+func (s *deepReconcileSchedule) completed(start time.Time, deepReconciled bool) {
+	if !deepReconciled {
+		s.runs++
+		return
+	}
+
+	s.runs = 0
+	s.last = start
+}
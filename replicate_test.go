@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestDeepReconcileSchedule(t *testing.T) {
+	type run struct {
+		at  time.Duration
+		due bool
+		// failed runs are not recorded as deep reconciles.
+		failed bool
+	}
+
+	var cases = []struct {
+		name      string
+		interval  time.Duration
+		everyRuns int
+		runs      []run
+	}{
+		{
+			name: "Disabled",
+			runs: []run{{at: 0}, {at: time.Hour}, {at: 24 * time.Hour}},
+		},
+		{
+			name:     "IntervalFirstRun",
+			interval: time.Hour,
+			runs: []run{
+				{at: 0, due: true},
+				{at: 30 * time.Minute},
+				{at: time.Hour, due: true},
+				{at: 90 * time.Minute},
+			},
+		},
+		{
+			name:     "IntervalFailedDeepReconcile",
+			interval: time.Hour,
+			runs: []run{
+				{at: 0, due: true, failed: true},
+				{at: time.Minute, due: true},
+				{at: 2 * time.Minute},
+			},
+		},
+		{
+			name:      "EveryRuns",
+			everyRuns: 3,
+			runs: []run{
+				{at: 0},
+				{at: time.Minute},
+				{at: 2 * time.Minute, due: true},
+				{at: 3 * time.Minute},
+				{at: 4 * time.Minute},
+				{at: 5 * time.Minute, due: true, failed: true},
+				{at: 6 * time.Minute, due: true},
+				{at: 7 * time.Minute},
+			},
+		},
+		{
+			name:      "IntervalAndEveryRuns",
+			interval:  time.Hour,
+			everyRuns: 2,
+			runs: []run{
+				{at: 0, due: true},
+				{at: time.Minute},
+				{at: 2 * time.Minute, due: true},
+				{at: 62 * time.Minute, due: true},
+			},
+		},
+	}
+
+	start := time.Now()
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newDeepReconcileSchedule(c.interval, c.everyRuns)
+
+			for i, r := range c.runs {
+				now := start.Add(r.at)
+				due := s.due(now)
+				testutil.Equals(t, r.due, due, "run %d", i)
+
+				s.completed(now, due && !r.failed)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	minio "github.com/minio/minio-go/v6"
+	"google.golang.org/api/googleapi"
+)
+
+// Object store operations retried on transient errors.
+const (
+	operationGet    = "get"
+	operationUpload = "upload"
+	operationExists = "exists"
+)
+
+// retryOptions configures the retries of single object store operations.
+type retryOptions struct {
+	// attempts is the maximum number of attempts of an operation, including
+	// the first one.
+	attempts int
+	// minBackoff is the backoff before the first retry, doubled for every
+	// following retry.
+	minBackoff time.Duration
+	// maxBackoff caps the backoff between retries.
+	maxBackoff time.Duration
+}
+
+// backoff returns the time to wait before the given retry, starting at 1. It
+// grows exponentially with a random jitter of up to half of it, so that
+// concurrent workers do not retry in lockstep.
+func (o retryOptions) backoff(retry int) time.Duration {
+	d := o.minBackoff
+	for i := 1; i < retry && d < o.maxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > o.maxBackoff {
+		d = o.maxBackoff
+	}
+
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retry calls f until it succeeds, fails with a permanent error or runs out
+// of attempts. It returns the last error of f.
+func (rs *replicationScheme) retry(ctx context.Context, operation string, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= rs.opts.retry.attempts || !isRetriable(err) {
+			return err
+		}
+
+		backoff := rs.opts.retry.backoff(attempt)
+		level.Warn(rs.logger).Log("msg", "retrying object store operation", "operation", operation, "attempt", attempt, "backoff", backoff, "err", err)
+		rs.metrics.operationRetries.WithLabelValues(operation).Inc()
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// isRetriable returns whether an object store error is likely transient,
+// such as timeouts, server errors and throttling, as opposed to permanent
+// errors like missing objects or denied access.
+func isRetriable(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case minio.ErrorResponse:
+			return isRetriableStatus(e.StatusCode) || e.Code == "SlowDown" || e.Code == "RequestTimeout"
+		case *googleapi.Error:
+			return isRetriableStatus(e.Code)
+		case interface{ Response() *http.Response }:
+			// Azure storage errors.
+			if r := e.Response(); r != nil {
+				return isRetriableStatus(r.StatusCode)
+			}
+		case net.Error:
+			if e.Timeout() || e.Temporary() {
+				return true
+			}
+		}
+
+		if err == context.Canceled {
+			return false
+		}
+
+		if err == context.DeadlineExceeded || err == io.ErrUnexpectedEOF {
+			return true
+		}
+
+		err = unwrapError(err)
+	}
+
+	return false
+}
+
+func isRetriableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// unwrapError returns the error wrapped by err, supporting both standard
+// library wrapping and github.com/pkg/errors causes.
+func unwrapError(err error) error {
+	switch e := err.(type) {
+	case interface{ Unwrap() error }:
+		return e.Unwrap()
+	case interface{ Cause() error }:
+		return e.Cause()
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	minio "github.com/minio/minio-go/v6"
+	"github.com/pkg/errors"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/tsdb/testutil"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsRetriable(t *testing.T) {
+	for _, c := range []struct {
+		err       error
+		retriable bool
+	}{
+		{err: errors.New("permanent"), retriable: false},
+		{err: context.Canceled, retriable: false},
+		{err: context.DeadlineExceeded, retriable: true},
+		{err: errors.Wrap(io.ErrUnexpectedEOF, "read object"), retriable: true},
+		{err: errors.Wrap(minio.ErrorResponse{StatusCode: http.StatusServiceUnavailable}, "upload"), retriable: true},
+		{err: minio.ErrorResponse{Code: "SlowDown", StatusCode: http.StatusOK}, retriable: true},
+		{err: minio.ErrorResponse{Code: "AccessDenied", StatusCode: http.StatusForbidden}, retriable: false},
+		{err: &googleapi.Error{Code: http.StatusTooManyRequests}, retriable: true},
+		{err: &googleapi.Error{Code: http.StatusNotFound}, retriable: false},
+	} {
+		testutil.Equals(t, c.retriable, isRetriable(c.err), "error %v", c.err)
+	}
+}
+
+func TestRetryOptionsBackoff(t *testing.T) {
+	o := retryOptions{minBackoff: time.Second, maxBackoff: 5 * time.Second}
+
+	for retry, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		d := o.backoff(retry + 1)
+		testutil.Assert(t, d >= max/2 && d <= max, "backoff of retry %d out of range: %v", retry+1, d)
+	}
+
+	testutil.Equals(t, time.Duration(0), retryOptions{}.backoff(1))
+}
+
+// flakyBucket fails the first calls of every operation on every object with
+// the error.
+type flakyBucket struct {
+	objstore.Bucket
+
+	err      error
+	failures int
+	// only restricts the failures to the given object, if set.
+	only string
+
+	mtx   sync.Mutex
+	calls map[string]int
+}
+
+func (b *flakyBucket) fail(operation, name string) error {
+	if b.only != "" && name != b.only {
+		return nil
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.calls[operation+" "+name]++
+	if b.calls[operation+" "+name] <= b.failures {
+		return b.err
+	}
+
+	return nil
+}
+
+func (b *flakyBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.fail(operationGet, name); err != nil {
+		return nil, err
+	}
+
+	return b.Bucket.Get(ctx, name)
+}
+
+func (b *flakyBucket) Exists(ctx context.Context, name string) (bool, error) {
+	if err := b.fail(operationExists, name); err != nil {
+		return false, err
+	}
+
+	return b.Bucket.Exists(ctx, name)
+}
+
+func (b *flakyBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := b.fail(operationUpload, name); err != nil {
+		return err
+	}
+
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func TestReplicationSchemeRetries(t *testing.T) {
+	ctx := context.Background()
+	logger := testLogger(t.Name())
+	originBucket := inmem.NewBucket()
+
+	b, err := json.Marshal(testMeta(testULID(0)))
+	testutil.Ok(t, err)
+	testutil.Ok(t, originBucket.Upload(ctx, path.Join(testULID(0).String(), "meta.json"), bytes.NewReader(b)))
+	testutil.Ok(t, originBucket.Upload(ctx, path.Join(testULID(0).String(), "chunks", "000001"), bytes.NewReader([]byte("chunks"))))
+	testutil.Ok(t, originBucket.Upload(ctx, path.Join(testULID(0).String(), "index"), bytes.NewReader([]byte("index"))))
+
+	filter := testBlockFilter(logger, newReplicationMetrics(nil).blocksFiltered)
+
+	execute := func(err error, attempts int) (*replicationMetrics, *inmem.Bucket, error) {
+		metrics := newReplicationMetrics(nil)
+		targetBucket := inmem.NewBucket()
+		target := &flakyBucket{Bucket: targetBucket, err: err, failures: 1, calls: map[string]int{}}
+		opts := replicationOptions{retry: retryOptions{attempts: attempts, minBackoff: time.Millisecond, maxBackoff: time.Millisecond}}
+
+		rs := newReplicationScheme(logger, metrics, filter, opts, []*replicationOrigin{{name: defaultBucketName, bkt: originBucket}}, []*replicationTarget{{name: defaultBucketName, bkt: target}})
+
+		return metrics, targetBucket, rs.execute(ctx)
+	}
+
+	// Transient errors are retried.
+	metrics, targetBucket, err := execute(minio.ErrorResponse{Code: "InternalError", StatusCode: http.StatusInternalServerError}, 2)
+	testutil.Ok(t, err)
+	testutil.Equals(t, originBucket.Objects(), targetBucket.Objects())
+
+	// Two chunk and index exists checks, two object uploads and the meta
+	// file upload.
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(metrics.operationRetries.WithLabelValues(operationExists)))
+	testutil.Equals(t, 3.0, promtestutil.ToFloat64(metrics.operationRetries.WithLabelValues(operationUpload)))
+
+	// Running out of attempts fails the run.
+	_, _, err = execute(minio.ErrorResponse{Code: "InternalError", StatusCode: http.StatusInternalServerError}, 1)
+	testutil.NotOk(t, err)
+
+	// Permanent errors are not retried.
+	metrics, _, err = execute(minio.ErrorResponse{Code: "AccessDenied", StatusCode: http.StatusForbidden}, 2)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.operationRetries.WithLabelValues(operationExists)))
+}
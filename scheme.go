@@ -3,342 +3,1925 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
+	"math"
 	"path"
+	"reflect"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	terrors "github.com/prometheus/prometheus/tsdb/errors"
 	"github.com/prometheus/prometheus/tsdb/labels"
 	thanosblock "github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/compact"
+	"github.com/thanos-io/thanos/pkg/model"
 	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/runutil"
 )
 
+// timeRangeMode defines how the time range of a block is compared to the
+// selected time range.
+type timeRangeMode string
+
+const (
+	// timeRangeOverlap selects blocks overlapping the time range.
+	timeRangeOverlap timeRangeMode = "overlap"
+	// timeRangeContain selects blocks fully contained in the time range.
+	timeRangeContain timeRangeMode = "contain"
+)
+
+// timeRange selects blocks by their time range. Unset bounds are unbounded,
+// relative bounds are evaluated on every use.
+type timeRange struct {
+	minTime *model.TimeOrDurationValue
+	maxTime *model.TimeOrDurationValue
+	mode    timeRangeMode
+}
+
+// bounds returns the minimum and maximum timestamp in milliseconds.
+func (tr timeRange) bounds() (int64, int64) {
+	minTime, maxTime := int64(math.MinInt64), int64(math.MaxInt64)
+
+	if tr.minTime != nil {
+		minTime = tr.minTime.PrometheusTimestamp()
+	}
+
+	if tr.maxTime != nil {
+		maxTime = tr.maxTime.PrometheusTimestamp()
+	}
+
+	return minTime, maxTime
+}
+
+// sourceFilter selects blocks by the source that uploaded them.
+type sourceFilter struct {
+	// include are the selected sources, all sources are selected if empty.
+	include []metadata.SourceType
+	// exclude are the sources never selected, even if included.
+	exclude []metadata.SourceType
+}
+
+// matches returns whether blocks uploaded by the source are selected.
+func (sf sourceFilter) matches(source metadata.SourceType) bool {
+	for _, s := range sf.exclude {
+		if s == source {
+			return false
+		}
+	}
+
+	if len(sf.include) == 0 {
+		return true
+	}
+
+	for _, s := range sf.include {
+		if s == source {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reasons for filtering blocks, used as label of the filtered blocks metric.
+const (
+	filterReasonLabels     = "labels"
+	filterReasonResolution = "resolution"
+	filterReasonCompaction = "compaction"
+	filterReasonTimeRange  = "time-range"
+	filterReasonSource     = "source"
+	// filterReasonDroppedByRelabel is not a block filter, it is counted for
+	// blocks whose external labels were all dropped by the relabel config.
+	filterReasonDroppedByRelabel = "dropped-by-relabel"
+)
+
 // BlockFilter is block filter that filters out compacted and unselected blocks.
 type BlockFilter struct {
-	logger          log.Logger
-	labelSelector   labels.Selector
-	resolutionLevel compact.ResolutionLevel
-	compactionLevel int
+	logger           log.Logger
+	filtered         *prometheus.CounterVec
+	labelSelector    labels.Selector
+	resolutionLevels levelSet
+	compactionLevels levelSet
+	timeRange        timeRange
+	sources          sourceFilter
 }
 
-// NewBlockFilter returns block filter.
+// NewBlockFilter returns block filter. Filtered blocks are counted in the
+// filtered metric by reason.
 func NewBlockFilter(
 	logger log.Logger,
+	filtered *prometheus.CounterVec,
 	labelSelector labels.Selector,
-	resolutionLevel compact.ResolutionLevel,
-	compactionLevel int,
+	resolutionLevels levelSet,
+	compactionLevels levelSet,
+	timeRange timeRange,
+	sources sourceFilter,
 ) *BlockFilter {
 	return &BlockFilter{
-		labelSelector:   labelSelector,
-		logger:          logger,
-		resolutionLevel: resolutionLevel,
-		compactionLevel: compactionLevel,
+		labelSelector:    labelSelector,
+		logger:           logger,
+		filtered:         filtered,
+		resolutionLevels: resolutionLevels,
+		compactionLevels: compactionLevels,
+		timeRange:        timeRange,
+		sources:          sources,
 	}
 }
 
 // Filter return true if block is non-compacted and matches selector.
 func (bf *BlockFilter) Filter(b *metadata.Meta) bool {
+	return bf.FilterReason(b) == ""
+}
+
+// FilterReason returns the reason why the block is filtered out, or an empty
+// string if it is selected.
+func (bf *BlockFilter) FilterReason(b *metadata.Meta) string {
 	blockLabels := labels.FromMap(b.Thanos.Labels)
 
 	labelMatch := bf.labelSelector.Matches(blockLabels)
 	if !labelMatch {
-		selStr := "{"
+		level.Debug(bf.logger).Log("msg", "filtering block", "reason", "labels don't match", "block_labels", blockLabels.String(), "selector", selectorString(bf.labelSelector))
+		bf.filtered.WithLabelValues(filterReasonLabels).Inc()
 
-		for i, m := range bf.labelSelector {
-			if i != 0 {
-				selStr += ","
-			}
+		return filterReasonLabels
+	}
 
-			selStr += m.String()
-		}
+	gotResolution := b.Thanos.Downsample.Resolution
+	expectedResolutions := bf.resolutionLevels
+
+	resolutionMatch := expectedResolutions.contains(gotResolution)
+	if !resolutionMatch {
+		level.Debug(bf.logger).Log("msg", "filtering block", "reason", "resolutions don't match", "got_resolution", gotResolution, "expected_resolutions", expectedResolutions.String())
+		bf.filtered.WithLabelValues(filterReasonResolution).Inc()
+
+		return filterReasonResolution
+	}
 
-		selStr += "}"
+	gotCompactionLevel := b.BlockMeta.Compaction.Level
+	expectedCompactionLevels := bf.compactionLevels
 
-		level.Debug(bf.logger).Log("msg", "filtering block", "reason", "labels don't match", "block_labels", blockLabels.String(), "selector", selStr)
+	compactionMatch := expectedCompactionLevels.contains(int64(gotCompactionLevel))
+	if !compactionMatch {
+		level.Debug(bf.logger).Log("msg", "filtering block", "reason", "compaction levels don't match", "got_compaction_level", gotCompactionLevel, "expected_compaction_levels", expectedCompactionLevels.String())
+		bf.filtered.WithLabelValues(filterReasonCompaction).Inc()
 
-		return false
+		return filterReasonCompaction
 	}
 
-	gotResolution := compact.ResolutionLevel(b.Thanos.Downsample.Resolution)
-	expectedResolution := bf.resolutionLevel
+	minTime, maxTime := bf.timeRange.bounds()
 
-	resolutionMatch := gotResolution == expectedResolution
-	if !resolutionMatch {
-		level.Debug(bf.logger).Log("msg", "filtering block", "reason", "resolutions don't match", "got_resolution", gotResolution, "expected_resolution", expectedResolution)
-		return false
+	// Block time ranges are half-open, the max time is exclusive.
+	timeRangeMatch := b.BlockMeta.MinTime <= maxTime && b.BlockMeta.MaxTime > minTime
+	if bf.timeRange.mode == timeRangeContain {
+		timeRangeMatch = b.BlockMeta.MinTime >= minTime && b.BlockMeta.MaxTime <= maxTime
 	}
 
-	gotCompactionLevel := b.BlockMeta.Compaction.Level
-	expectedCompactionLevel := bf.compactionLevel
+	if !timeRangeMatch {
+		level.Debug(bf.logger).Log("msg", "filtering block", "reason", "time ranges don't match", "block_min_time", b.BlockMeta.MinTime, "block_max_time", b.BlockMeta.MaxTime, "min_time", minTime, "max_time", maxTime, "mode", bf.timeRange.mode)
+		bf.filtered.WithLabelValues(filterReasonTimeRange).Inc()
 
-	compactionMatch := gotCompactionLevel == expectedCompactionLevel
-	if !compactionMatch {
-		level.Debug(bf.logger).Log("msg", "filtering block", "reason", "compaction levels don't match", "got_compaction_level", gotCompactionLevel, "expected_compaction_level", expectedCompactionLevel)
-		return false
+		return filterReasonTimeRange
 	}
 
-	return true
+	if !bf.sources.matches(b.Thanos.Source) {
+		level.Debug(bf.logger).Log("msg", "filtering block", "reason", "sources don't match", "got_source", b.Thanos.Source, "included_sources", fmt.Sprint(bf.sources.include), "excluded_sources", fmt.Sprint(bf.sources.exclude))
+		bf.filtered.WithLabelValues(filterReasonSource).Inc()
+
+		return filterReasonSource
+	}
+
+	return ""
+}
+
+// blockFilterFunc returns the reason why a block is filtered out, or an empty
+// string if it is selected.
+type blockFilterFunc func(b *metadata.Meta) string
+
+// resolutionLabel returns the value of the resolution label of per resolution
+// metrics.
+func resolutionLabel(meta *metadata.Meta) string {
+	return strconv.FormatInt(meta.Thanos.Downsample.Resolution, 10)
 }
 
-type blockFilterFunc func(b *metadata.Meta) bool
+// objectVerification defines how an object already present in the target
+// bucket is checked before it is considered replicated.
+type objectVerification string
+
+const (
+	// objectVerificationExists only checks that the object exists.
+	objectVerificationExists objectVerification = "exists"
+	// objectVerificationSize compares the size of the origin and target object.
+	// Without a stat call in the object store client, both objects are read in
+	// full, as for objectVerificationHash.
+	objectVerificationSize objectVerification = "size"
+	// objectVerificationHash compares the size and the SHA-256 of the origin
+	// and target object.
+	objectVerificationHash objectVerification = "hash"
+)
+
+// replicationOptions holds the tunables of a replicationScheme.
+type replicationOptions struct {
+	// blockConcurrency is the number of blocks replicated in parallel.
+	blockConcurrency int
+	// objectConcurrency is the number of objects replicated in parallel
+	// within a single block.
+	objectConcurrency int
+	// objectVerification defines how existing target objects are verified.
+	objectVerification objectVerification
+	// deepReconcile makes the run check every object of blocks whose meta
+	// file was already replicated, instead of skipping them.
+	deepReconcile bool
+	// consistencyDelay is the minimum age of a block, based on its ULID,
+	// before it is replicated.
+	consistencyDelay time.Duration
+	// mirror configures the deletion of target blocks that are no longer
+	// present in the origin bucket.
+	mirror mirrorOptions
+	// skipCompactedInTarget skips origin blocks that were already compacted
+	// into a larger block in the target bucket.
+	skipCompactedInTarget bool
+	// injectLabels are the external labels set on blocks without any, the
+	// same way the Thanos shipper does.
+	injectLabels labels.Labels
+	// relabelConfigs are applied to the external labels of the meta file
+	// written to the target bucket.
+	relabelConfigs []*relabel.Config
+	// indexHealthCheck configures the check of the index of blocks before
+	// they are replicated.
+	indexHealthCheck indexHealthCheckOptions
+	// dryRun scans the origin and target buckets without uploading or
+	// deleting anything, recording what would be done in the plan instead.
+	dryRun bool
+	// dryRunSizes reads the objects missing in a target from the origin
+	// bucket in dry runs to report their size.
+	dryRunSizes bool
+	// retry configures the retries of object store operations failing with
+	// transient errors.
+	retry retryOptions
+	// continueOnError keeps replicating the remaining blocks to a target once
+	// a block failed.
+	continueOnError continueOnErrorOptions
+	// objectSizes remembers the size of origin objects across runs, to
+	// compute a lower bound of the bytes pending replication.
+	objectSizes *objectSizes
+}
 
 type replicationScheme struct {
-	fromBkt objstore.BucketReader
-	toBkt   objstore.Bucket
+	origins []*replicationOrigin
+	targets []*replicationTarget
 
 	blockFilter blockFilterFunc
+	opts        replicationOptions
 
 	logger  log.Logger
 	metrics *replicationMetrics
+
+	// Per run summary of a deep reconcile, updated atomically.
+	reconciledBlocks int64
+	repairedBlocks   int64
+
+	// failedTargets holds the first error of every target that failed in
+	// this run. No further blocks are replicated to a failed target.
+	mtx           sync.Mutex
+	failedTargets map[string]error
+	// failedBlocks holds the errors of the blocks that failed in this run in
+	// continue on error mode, in which targets do not fail on failed blocks.
+	failedBlocks map[blockFailureKey]error
+
+	// plan is only set in dry runs.
+	plan *replicationPlan
 }
 
 type replicationMetrics struct {
-	originIterations  prometheus.Counter
-	originMetaLoads   prometheus.Counter
-	originPartialMeta prometheus.Counter
+	originIterations      *prometheus.CounterVec
+	originMetaLoads       *prometheus.CounterVec
+	originPartialMeta     *prometheus.CounterVec
+	originTooFresh        *prometheus.CounterVec
+	originBlockCollisions *prometheus.GaugeVec
+
+	blocksFiltered *prometheus.CounterVec
+
+	blocksAlreadyReplicated *prometheus.CounterVec
+	blocksCompactedInTarget *prometheus.CounterVec
+	blocksReplicated        *prometheus.CounterVec
+	objectsReplicated       *prometheus.CounterVec
+
+	targetBlockFailures     *prometheus.CounterVec
+	targetLastSuccessfulRun *prometheus.GaugeVec
+
+	blocksInFlight      prometheus.Gauge
+	blocksWaitingForOld prometheus.Gauge
+	objectsInFlight     prometheus.Gauge
+
+	objectsVerified   prometheus.Counter
+	objectsMismatched *prometheus.CounterVec
+
+	deepReconcileRuns            prometheus.Counter
+	deepReconcileBlocksChecked   prometheus.Counter
+	deepReconcileBlocksRepaired  prometheus.Counter
+	deepReconcileObjectsRepaired prometheus.Counter
+
+	mirrorDeletionCandidates *prometheus.GaugeVec
+	mirrorBlocksDeleted      *prometheus.CounterVec
+
+	indexHealthChecks *prometheus.CounterVec
+	quarantinedBlocks *prometheus.GaugeVec
+
+	rateLimit          *prometheus.GaugeVec
+	rateLimitWaiting   *prometheus.GaugeVec
+	rateLimitThrottled *prometheus.CounterVec
+
+	operationRetries *prometheus.CounterVec
+
+	failedBlocks  *prometheus.GaugeVec
+	blockedBlocks *prometheus.GaugeVec
+
+	pendingBlocks               *prometheus.GaugeVec
+	pendingBytes                *prometheus.GaugeVec
+	oldestPendingBlockTimestamp *prometheus.GaugeVec
+	oldestPendingBlockMaxTime   *prometheus.GaugeVec
+	newestReplicatedMaxTime     *prometheus.GaugeVec
 
-	blocksAlreadyReplicated prometheus.Counter
-	blocksReplicated        prometheus.Counter
-	objectsReplicated       prometheus.Counter
+	originBytesRead    *prometheus.CounterVec
+	targetBytesWritten *prometheus.CounterVec
+	objectDuration     *prometheus.HistogramVec
+	objectSize         *prometheus.HistogramVec
+	blockDuration      *prometheus.HistogramVec
+	blockSize          *prometheus.HistogramVec
 }
 
 func newReplicationMetrics(reg prometheus.Registerer) *replicationMetrics {
 	m := &replicationMetrics{
-		originIterations: prometheus.NewCounter(prometheus.CounterOpts{
+		originIterations: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "thanos_replicate_origin_iterations_total",
-			Help: "Total number of objects iterated over in the origin bucket.",
-		}),
-		originMetaLoads: prometheus.NewCounter(prometheus.CounterOpts{
+			Help: "Total number of objects iterated over in the origin bucket, split by origin.",
+		}, []string{"origin"}),
+		originMetaLoads: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "thanos_replicate_origin_meta_loads_total",
-			Help: "Total number of meta.json reads in the origin bucket.",
-		}),
-		originPartialMeta: prometheus.NewCounter(prometheus.CounterOpts{
+			Help: "Total number of meta.json reads in the origin bucket, split by origin.",
+		}, []string{"origin"}),
+		originPartialMeta: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "thanos_replicate_origin_partial_meta_reads_total",
-			Help: "Total number of partial meta reads encountered.",
-		}),
-		blocksAlreadyReplicated: prometheus.NewCounter(prometheus.CounterOpts{
+			Help: "Total number of partial meta reads encountered, split by origin.",
+		}, []string{"origin"}),
+		originTooFresh: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_replicate_origin_too_fresh_blocks_total",
+			Help: "Total number of origin blocks skipped due to being younger than the consistency delay, split by origin.",
+		}, []string{"origin"}),
+		originBlockCollisions: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_replicate_origin_block_collisions",
+			Help: "Number of blocks of the origin skipped in the last run because another origin has a block with the same ID but a different meta, split by origin.",
+		}, []string{"origin"}),
+		blocksFiltered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_replicate_blocks_filtered_total",
+			Help: "Total number of blocks not selected by the block filters or with all external labels dropped by the relabel config, split by reason.",
+		}, []string{"reason"}),
+		blocksAlreadyReplicated: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "thanos_replicate_blocks_already_replicated_total",
-			Help: "Total number of blocks skipped due to already being replicated.",
-		}),
-		blocksReplicated: prometheus.NewCounter(prometheus.CounterOpts{
+			Help: "Total number of blocks skipped due to already being replicated, split by resolution, origin and target.",
+		}, []string{"resolution", "origin", "target"}),
+		blocksCompactedInTarget: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_replicate_blocks_compacted_in_target_total",
+			Help: "Total number of blocks skipped due to already being a source of a compacted block in the target bucket, split by target.",
+		}, []string{"target"}),
+		blocksReplicated: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "thanos_replicate_blocks_replicated_total",
-			Help: "Total number of blocks replicated.",
-		}),
-		objectsReplicated: prometheus.NewCounter(prometheus.CounterOpts{
+			Help: "Total number of blocks replicated, split by resolution, origin and target.",
+		}, []string{"resolution", "origin", "target"}),
+		objectsReplicated: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "thanos_replicate_objects_replicated_total",
-			Help: "Total number of objects replicated.",
+			Help: "Total number of objects replicated, split by resolution, origin and target.",
+		}, []string{"resolution", "origin", "target"}),
+		targetBlockFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_replicate_target_block_failures_total",
+			Help: "Total number of blocks that failed to be replicated, split by origin and target.",
+		}, []string{"origin", "target"}),
+		targetLastSuccessfulRun: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_replicate_target_last_successful_run_timestamp_seconds",
+			Help: "Timestamp of the last replication run that fully succeeded, split by target.",
+		}, []string{"target"}),
+		blocksInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_replicate_blocks_in_flight",
+			Help: "Number of blocks currently being replicated.",
+		}),
+		blocksWaitingForOld: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_replicate_blocks_waiting_for_older_blocks",
+			Help: "Number of blocks waiting for older blocks of the same group to be replicated before uploading their meta file.",
+		}),
+		objectsInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_replicate_objects_in_flight",
+			Help: "Number of objects currently being replicated.",
+		}),
+		objectsVerified: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_replicate_objects_verified_total",
+			Help: "Total number of objects present in the target bucket whose content was verified against the origin bucket.",
 		}),
+		objectsMismatched: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_replicate_objects_mismatched_total",
+			Help: "Total number of objects present in the target bucket whose content did not match the origin bucket, split by reason.",
+		}, []string{"reason"}),
+		deepReconcileRuns: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_replicate_deep_reconcile_runs_total",
+			Help: "Total number of replication runs that checked every object of already replicated blocks.",
+		}),
+		deepReconcileBlocksChecked: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_replicate_deep_reconcile_blocks_checked_total",
+			Help: "Total number of already replicated blocks checked by a deep reconcile.",
+		}),
+		deepReconcileBlocksRepaired: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_replicate_deep_reconcile_blocks_repaired_total",
+			Help: "Total number of already replicated blocks that had missing or mismatching objects repaired by a deep reconcile.",
+		}),
+		deepReconcileObjectsRepaired: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_replicate_deep_reconcile_objects_repaired_total",
+			Help: "Total number of objects of already replicated blocks repaired by a deep reconcile.",
+		}),
+		mirrorDeletionCandidates: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_replicate_mirror_deletion_candidates",
+			Help: "Number of target blocks replicated from the origin bucket and no longer present in it in the last mirror run, split by target. Only counts blocks compacted into another block of the target bucket. They are deleted once missing for the minimum age.",
+		}, []string{"target"}),
+		mirrorBlocksDeleted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_replicate_mirror_blocks_deleted_total",
+			Help: "Total number of target blocks deleted because they are no longer present in the origin bucket, split by target.",
+		}, []string{"target"}),
+		indexHealthChecks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_replicate_index_health_checks_total",
+			Help: "Total number of index health checks of origin blocks before their replication, split by result.",
+		}, []string{"result"}),
+		quarantinedBlocks: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_replicate_quarantined_blocks",
+			Help: "Blocks not replicated due to a failed index health check until cleared from the quarantine, set to 1 per block.",
+		}, []string{"block_uuid", "origin"}),
+		rateLimit: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_replicate_rate_limit",
+			Help: "Configured rate limit per second, split by direction and limited resource, either bytes or ops.",
+		}, []string{"direction", "resource"}),
+		rateLimitWaiting: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_replicate_rate_limit_waiting",
+			Help: "Number of object store calls and transfers currently throttled by a rate limit, split by direction and limited resource.",
+		}, []string{"direction", "resource"}),
+		rateLimitThrottled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_replicate_rate_limit_throttled_seconds_total",
+			Help: "Total time spent waiting for a rate limit, split by direction and limited resource.",
+		}, []string{"direction", "resource"}),
+		operationRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_replicate_operation_retries_total",
+			Help: "Total number of object store operations retried after a transient error, split by operation.",
+		}, []string{"operation"}),
+		failedBlocks: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_replicate_failed_blocks",
+			Help: "Number of consecutive replication runs a block failed to be replicated to a target in continue on error mode, split by block and target.",
+		}, []string{"block_uuid", "target"}),
+		blockedBlocks: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_replicate_blocked_blocks",
+			Help: "Number of blocks not replicated to the target in the last run as an older block of the same group failed, split by target. Blocked blocks are retried in the next run.",
+		}, []string{"target"}),
+		pendingBlocks: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_replicate_pending_blocks",
+			Help: "Number of candidate blocks not replicated to the target at the end of the last run, split by target.",
+		}, []string{"target"}),
+		pendingBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_replicate_pending_bytes",
+			Help: "Lower bound of the size of the candidate blocks not replicated to the target at the end of the last run, split by target. Object sizes are only known once objects were read from the origin, e.g. by an earlier replication attempt, so objects never read are not counted. Objects known to be present in the target are not counted either.",
+		}, []string{"target"}),
+		oldestPendingBlockTimestamp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_replicate_oldest_pending_block_timestamp_seconds",
+			Help: "Creation time, based on its ULID, of the oldest candidate block not replicated to the target at the end of the last run, split by target. 0 if no block is pending.",
+		}, []string{"target"}),
+		oldestPendingBlockMaxTime: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_replicate_oldest_pending_block_max_time_seconds",
+			Help: "Maximum time of the oldest candidate block not replicated to the target at the end of the last run, split by target. 0 if no block is pending.",
+		}, []string{"target"}),
+		newestReplicatedMaxTime: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_replicate_newest_replicated_block_max_time_seconds",
+			Help: "Maximum time of the newest candidate block replicated to the target in the last run, split by target and external labels.",
+		}, []string{"target", "external_labels"}),
+		originBytesRead: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_replicate_origin_read_bytes_total",
+			Help: "Total number of bytes of objects read from the origin bucket to be replicated or verified, split by origin.",
+		}, []string{"origin"}),
+		targetBytesWritten: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_replicate_target_written_bytes_total",
+			Help: "Total number of bytes uploaded to the target bucket, including failed uploads, split by target.",
+		}, []string{"target"}),
+		objectDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "thanos_replicate_object_replication_duration_seconds",
+			Help:    "Duration of the replication of single objects copied to at least one target, including retries, split by origin.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 16),
+		}, []string{"origin"}),
+		objectSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "thanos_replicate_object_replication_size_bytes",
+			Help:    "Size of single objects copied to at least one target, split by origin.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 12),
+		}, []string{"origin"}),
+		blockDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "thanos_replicate_block_replication_duration_seconds",
+			Help:    "Duration of the replication of blocks replicated to at least one target, excluding waiting for older blocks, split by origin.",
+			Buckets: prometheus.ExponentialBuckets(0.1, 2, 18),
+		}, []string{"origin"}),
+		blockSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "thanos_replicate_block_replication_size_bytes",
+			Help:    "Size of the objects copied for blocks replicated to at least one target, excluding objects that were already present in all targets, split by origin.",
+			Buckets: prometheus.ExponentialBuckets(1024*1024, 4, 12),
+		}, []string{"origin"}),
 	}
 
 	if reg != nil {
 		reg.MustRegister(m.originIterations)
 		reg.MustRegister(m.originMetaLoads)
 		reg.MustRegister(m.originPartialMeta)
+		reg.MustRegister(m.originTooFresh)
+		reg.MustRegister(m.originBlockCollisions)
+		reg.MustRegister(m.blocksFiltered)
 		reg.MustRegister(m.blocksAlreadyReplicated)
+		reg.MustRegister(m.blocksCompactedInTarget)
 		reg.MustRegister(m.blocksReplicated)
 		reg.MustRegister(m.objectsReplicated)
+		reg.MustRegister(m.targetBlockFailures)
+		reg.MustRegister(m.targetLastSuccessfulRun)
+		reg.MustRegister(m.blocksInFlight)
+		reg.MustRegister(m.blocksWaitingForOld)
+		reg.MustRegister(m.objectsInFlight)
+		reg.MustRegister(m.objectsVerified)
+		reg.MustRegister(m.objectsMismatched)
+		reg.MustRegister(m.deepReconcileRuns)
+		reg.MustRegister(m.deepReconcileBlocksChecked)
+		reg.MustRegister(m.deepReconcileBlocksRepaired)
+		reg.MustRegister(m.deepReconcileObjectsRepaired)
+		reg.MustRegister(m.mirrorDeletionCandidates)
+		reg.MustRegister(m.mirrorBlocksDeleted)
+		reg.MustRegister(m.indexHealthChecks)
+		reg.MustRegister(m.quarantinedBlocks)
+		reg.MustRegister(m.rateLimit)
+		reg.MustRegister(m.rateLimitWaiting)
+		reg.MustRegister(m.rateLimitThrottled)
+		reg.MustRegister(m.operationRetries)
+		reg.MustRegister(m.failedBlocks)
+		reg.MustRegister(m.blockedBlocks)
+		reg.MustRegister(m.pendingBlocks)
+		reg.MustRegister(m.pendingBytes)
+		reg.MustRegister(m.oldestPendingBlockTimestamp)
+		reg.MustRegister(m.oldestPendingBlockMaxTime)
+		reg.MustRegister(m.newestReplicatedMaxTime)
+		reg.MustRegister(m.originBytesRead)
+		reg.MustRegister(m.targetBytesWritten)
+		reg.MustRegister(m.objectDuration)
+		reg.MustRegister(m.objectSize)
+		reg.MustRegister(m.blockDuration)
+		reg.MustRegister(m.blockSize)
 	}
 
 	return m
 }
 
-func newReplicationScheme(logger log.Logger, metrics *replicationMetrics, blockFilter blockFilterFunc, from objstore.BucketReader, to objstore.Bucket) *replicationScheme {
+func newReplicationScheme(logger log.Logger, metrics *replicationMetrics, blockFilter blockFilterFunc, opts replicationOptions, origins []*replicationOrigin, targets []*replicationTarget) *replicationScheme {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
 
+	if opts.blockConcurrency < 1 {
+		opts.blockConcurrency = 1
+	}
+
+	if opts.objectConcurrency < 1 {
+		opts.objectConcurrency = 1
+	}
+
+	if opts.objectVerification == "" {
+		opts.objectVerification = objectVerificationExists
+	}
+
+	if opts.retry.attempts < 1 {
+		opts.retry.attempts = 1
+	}
+
+	if opts.indexHealthCheck.enabled && opts.indexHealthCheck.quarantine == nil {
+		opts.indexHealthCheck.quarantine = newQuarantine("")
+	}
+
+	if opts.continueOnError.enabled && opts.continueOnError.failures == nil {
+		opts.continueOnError.failures = newBlockFailures()
+	}
+
+	if opts.objectSizes == nil {
+		opts.objectSizes = newObjectSizes()
+	}
+
+	if opts.mirror.blockFilter == nil {
+		opts.mirror.blockFilter = blockFilter
+	}
+
+	if opts.mirror.state == nil {
+		opts.mirror.state = newMirrorState("")
+	}
+
+	if opts.mirror.maxDeletionRatio <= 0 {
+		opts.mirror.maxDeletionRatio = 1
+	}
+
+	var plan *replicationPlan
+	if opts.dryRun {
+		plan = newReplicationPlan(opts.dryRunSizes)
+		opts.mirror.dryRun = true
+	}
+
 	return &replicationScheme{
 		logger:      logger,
 		blockFilter: blockFilter,
-		fromBkt:     from,
-		toBkt:       to,
+		opts:        opts,
+		origins:     origins,
+		targets:     targets,
 		metrics:     metrics,
+
+		failedTargets: map[string]error{},
+		failedBlocks:  map[blockFailureKey]error{},
+		plan:          plan,
+	}
+}
+
+// skipBlock records in the plan of a dry run that a block is skipped, for
+// the given target only if set.
+func (rs *replicationScheme) skipBlock(id ulid.ULID, origin, target, reason string) {
+	if rs.plan != nil {
+		rs.plan.skip(id, origin, target, reason)
+	}
+}
+
+// failTarget records the error of a target, so that no further blocks are
+// replicated to it in this run. It returns whether all targets failed.
+func (rs *replicationScheme) failTarget(t *replicationTarget, err error) bool {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+
+	if _, ok := rs.failedTargets[t.name]; !ok {
+		level.Error(rs.logger).Log("msg", "replication to target failed, skipping it for the rest of the run", "target", t.name, "err", err)
+		rs.failedTargets[t.name] = err
+	}
+
+	return len(rs.failedTargets) == len(rs.targets)
+}
+
+// activeTargets returns the given targets that did not fail in this run.
+func (rs *replicationScheme) activeTargets(targets []*replicationTarget) []*replicationTarget {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+
+	active := make([]*replicationTarget, 0, len(targets))
+
+	for _, t := range targets {
+		if _, ok := rs.failedTargets[t.name]; !ok {
+			active = append(active, t)
+		}
+	}
+
+	return active
+}
+
+// targetsErr returns the errors of all failed targets.
+func (rs *replicationScheme) targetsErr() error {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+
+	var merr terrors.MultiError
+
+	for _, t := range rs.targets {
+		if err, ok := rs.failedTargets[t.name]; ok {
+			merr.Add(fmt.Errorf("replicate to target %v: %w", t.name, err))
+		}
+	}
+
+	return merr.Err()
+}
+
+// runErr returns the errors of all failed targets and blocks.
+func (rs *replicationScheme) runErr() error {
+	var merr terrors.MultiError
+
+	if err := rs.targetsErr(); err != nil {
+		merr.Add(err)
+	}
+
+	for _, err := range rs.blocksErr() {
+		merr.Add(err)
 	}
+
+	return merr.Err()
 }
 
 func (rs *replicationScheme) execute(ctx context.Context) error {
-	availableBlocks := []*metadata.Meta{}
+	if rs.opts.indexHealthCheck.enabled {
+		if err := rs.opts.indexHealthCheck.quarantine.reload(); err != nil {
+			return err
+		}
+
+		rs.updateQuarantineMetric()
+	}
+
+	// originBlocks holds every block present in the origin buckets, including
+	// partially uploaded ones, so mirroring never deletes them from the target.
+	originBlocks := map[ulid.ULID]struct{}{}
+	// found holds the blocks found in the origin buckets by ID, in the order
+	// of the origins.
+	found := map[ulid.ULID][]originBlock{}
+	ids := []ulid.ULID{}
+
+	for _, o := range rs.origins {
+		blocks, err := rs.scanOrigin(ctx, o, originBlocks)
+		if err != nil {
+			return err
+		}
+
+		for _, b := range blocks {
+			id := b.meta.BlockMeta.ULID
+			if _, ok := found[id]; !ok {
+				ids = append(ids, id)
+			}
+
+			found[id] = append(found[id], b)
+		}
+	}
+
+	if rs.opts.mirror.enabled {
+		rs.opts.mirror.state.observe(originBlocks)
+	}
+
+	collisions := make(map[string]int, len(rs.origins))
+	availableBlocks := make([]originBlock, 0, len(ids))
+
+	for _, id := range ids {
+		blocks := found[id]
+
+		if collided := blockCollisions(blocks); len(collided) > 0 {
+			names := make([]string, 0, len(collided))
+
+			for _, b := range collided {
+				names = append(names, b.origin.name)
+				collisions[b.origin.name]++
+			}
+
+			level.Error(rs.logger).Log("msg", "block ID present in several origin buckets with a different meta. Skipping.", "block_uuid", id.String(), "origins", strings.Join(names, ","))
+			rs.skipBlock(id, strings.Join(names, ","), "", skipReasonOriginCollision)
+
+			continue
+		}
+
+		// Blocks present in several origins with the same meta are only
+		// replicated from the first one.
+		b := blocks[0]
+
+		provenance := rs.rewriteMeta(b.meta)
+		if provenance != nil {
+			level.Debug(rs.logger).Log("msg", "rewrote external labels of block", "block_uuid", id.String(), "origin", b.origin.name, "labels", labels.FromMap(b.meta.Thanos.Labels).String())
+		}
+
+		if provenance != nil && len(b.meta.Thanos.Labels) == 0 {
+			level.Info(rs.logger).Log("msg", "all external labels of block dropped by relabel config. Skipping.", "block_uuid", id.String(), "origin", b.origin.name, "origin_labels", labels.FromMap(provenance.OriginLabels).String())
+			rs.metrics.blocksFiltered.WithLabelValues(filterReasonDroppedByRelabel).Inc()
+			rs.skipBlock(id, b.origin.name, "", skipReasonDroppedByRelabel)
+
+			continue
+		}
+
+		if len(b.meta.Thanos.Labels) == 0 {
+			level.Info(rs.logger).Log("msg", "block meta without Thanos external labels set. This is not allowed, use --label to inject labels. Skipping.", "block_uuid", id.String(), "origin", b.origin.name)
+			rs.skipBlock(id, b.origin.name, "", skipReasonNoExternalLabels)
+			continue
+		}
+
+		level.Debug(rs.logger).Log("msg", "adding block to available blocks", "block_uuid", id.String(), "origin", b.origin.name)
 
-	level.Debug(rs.logger).Log("msg", "scanning blocks available blocks for replication")
+		availableBlocks = append(availableBlocks, b)
+	}
+
+	for _, o := range rs.origins {
+		rs.metrics.originBlockCollisions.WithLabelValues(o.name).Set(float64(collisions[o.name]))
+	}
+
+	// compactedInTarget holds, per target, the source blocks that were
+	// compacted into another block of the target bucket.
+	compactedInTarget := map[string]map[string]map[ulid.ULID]ulid.ULID{}
+
+	if rs.opts.skipCompactedInTarget {
+		for _, t := range rs.targets {
+			sources, err := rs.loadTargetCompactionSources(ctx, t)
+			if err != nil {
+				rs.failTarget(t, err)
+				continue
+			}
+
+			compactedInTarget[t.name] = sources
+		}
+	}
+
+	candidateBlocks := []candidateBlock{}
+
+	for _, b := range availableBlocks {
+		if reason := rs.blockFilter(b.meta); reason != "" {
+			rs.skipBlock(b.meta.BlockMeta.ULID, b.origin.name, "", "filtered-"+reason)
+			continue
+		}
+
+		if rs.opts.indexHealthCheck.enabled && rs.opts.indexHealthCheck.quarantine.contains(b.meta.BlockMeta.ULID) {
+			level.Warn(rs.logger).Log("msg", "block is quarantined due to a failed index health check. Skipping.", "block_uuid", b.meta.BlockMeta.ULID.String(), "origin", b.origin.name)
+			rs.skipBlock(b.meta.BlockMeta.ULID, b.origin.name, "", skipReasonQuarantined)
+
+			continue
+		}
 
-	if err := rs.fromBkt.Iter(ctx, "", func(name string) error {
-		rs.metrics.originIterations.Inc()
+		targets := make([]*replicationTarget, 0, len(rs.targets))
+
+		for _, t := range rs.targets {
+			if compactedInto, ok := compactedInTarget[t.name][compact.GroupKey(b.meta.Thanos)][b.meta.BlockMeta.ULID]; ok {
+				level.Info(rs.logger).Log("msg", "block already compacted in target bucket. Skipping.", "block_uuid", b.meta.BlockMeta.ULID.String(), "target", t.name, "target_block_uuid", compactedInto.String())
+				rs.metrics.blocksCompactedInTarget.WithLabelValues(t.name).Inc()
+				rs.skipBlock(b.meta.BlockMeta.ULID, b.origin.name, t.name, skipReasonCompactedInTarget)
+
+				continue
+			}
+
+			targets = append(targets, t)
+		}
+
+		if len(targets) == 0 {
+			continue
+		}
+
+		level.Debug(rs.logger).Log("msg", "adding block to candidate blocks", "block_uuid", b.meta.BlockMeta.ULID.String())
+		candidateBlocks = append(candidateBlocks, candidateBlock{originBlock: b, targets: targets})
+	}
+
+	// In order to prevent races in compactions by the target environment, we
+	// need to replicate oldest start timestamp first.
+	sort.Slice(candidateBlocks, func(i, j int) bool {
+		return candidateBlocks[i].meta.BlockMeta.MinTime < candidateBlocks[j].meta.BlockMeta.MinTime
+	})
+
+	if rs.opts.deepReconcile {
+		level.Info(rs.logger).Log("msg", "running deep reconcile of already replicated blocks")
+		rs.metrics.deepReconcileRuns.Inc()
+	}
+
+	if rs.plan != nil {
+		if err := rs.planBlocks(ctx, candidateBlocks); err != nil {
+			return err
+		}
+	} else if err := rs.replicateBlocks(ctx, candidateBlocks); err != nil {
+		return err
+	}
+
+	if rs.opts.continueOnError.enabled && rs.plan == nil {
+		rs.updateFailedBlocks()
+	}
+
+	if rs.opts.deepReconcile {
+		level.Info(rs.logger).Log(
+			"msg", "deep reconcile finished",
+			"checked_blocks", atomic.LoadInt64(&rs.reconciledBlocks),
+			"repaired_blocks", atomic.LoadInt64(&rs.repairedBlocks),
+		)
+	}
+
+	// Only mirror deletions after a fully successful replication, so that the
+	// target never ends up with less data than before.
+	if rs.opts.mirror.enabled {
+		mirrored := 0
+
+		for _, t := range rs.activeTargets(rs.targets) {
+			if rs.hasFailedBlocks(t) {
+				level.Warn(rs.logger).Log("msg", "skipping mirror deletions as blocks failed to be replicated", "target", t.name)
+				continue
+			}
+
+			if err := rs.deleteBlocksMissingInOrigin(ctx, t, originBlocks); err != nil {
+				rs.failTarget(t, fmt.Errorf("mirror deletions: %w", err))
+				continue
+			}
+
+			mirrored++
+		}
+
+		// Blocks gone from the origins are only forgotten once every target
+		// had the chance to record them as missing.
+		if mirrored == len(rs.targets) {
+			rs.opts.mirror.state.prune(originBlocks)
+		}
+
+		if rs.plan == nil {
+			if err := rs.opts.mirror.state.save(); err != nil {
+				level.Warn(rs.logger).Log("msg", "failed to persist mirror state", "err", err)
+			}
+		}
+	}
+
+	if rs.plan != nil {
+		return rs.targetsErr()
+	}
+
+	for _, t := range rs.activeTargets(rs.targets) {
+		if !rs.hasFailedBlocks(t) {
+			rs.metrics.targetLastSuccessfulRun.WithLabelValues(t.name).SetToCurrentTime()
+		}
+	}
+
+	return rs.runErr()
+}
+
+// originBlock is a block found in an origin bucket.
+type originBlock struct {
+	origin *replicationOrigin
+	meta   *metadata.Meta
+}
+
+// scanOrigin returns the blocks of the origin bucket with a complete meta
+// file. Every block found, including partially uploaded ones, is added to
+// originBlocks.
+func (rs *replicationScheme) scanOrigin(ctx context.Context, o *replicationOrigin, originBlocks map[ulid.ULID]struct{}) ([]originBlock, error) {
+	blocks := []originBlock{}
+
+	level.Debug(rs.logger).Log("msg", "scanning blocks available blocks for replication", "origin", o.name)
+
+	if err := o.bkt.Iter(ctx, "", func(name string) error {
+		rs.metrics.originIterations.WithLabelValues(o.name).Inc()
 
 		id, ok := thanosblock.IsBlockDir(name)
 		if !ok {
 			return nil
 		}
 
-		rs.metrics.originMetaLoads.Inc()
-		meta, metaNonExistentOrPartial, err := loadMeta(ctx, rs.fromBkt, id)
+		originBlocks[id] = struct{}{}
+
+		// Freshly uploaded blocks may not be visible consistently yet, or be
+		// about to be compacted and deleted by an origin compactor.
+		if ulid.Now()-id.Time() < uint64(rs.opts.consistencyDelay/time.Millisecond) {
+			rs.metrics.originTooFresh.WithLabelValues(o.name).Inc()
+			rs.skipBlock(id, o.name, "", skipReasonTooFresh)
+			level.Debug(rs.logger).Log("msg", "block is too fresh for now. Skipping.", "block_uuid", id.String(), "origin", o.name)
+			return nil
+		}
+
+		rs.metrics.originMetaLoads.WithLabelValues(o.name).Inc()
+		meta, metaNonExistentOrPartial, err := loadMeta(ctx, o.bkt, id)
 		if metaNonExistentOrPartial {
 			// meta.json is the last file uploaded by a Thanos shipper,
 			// therefore a block may be partially present, but no meta.json
 			// file yet. If this is the case we skip that block for now.
-			rs.metrics.originPartialMeta.Inc()
-			level.Info(rs.logger).Log("msg", "block meta not uploaded yet. Skipping.", "block_uuid", id.String())
+			rs.metrics.originPartialMeta.WithLabelValues(o.name).Inc()
+			rs.skipBlock(id, o.name, "", skipReasonPartialMeta)
+			level.Info(rs.logger).Log("msg", "block meta not uploaded yet. Skipping.", "block_uuid", id.String(), "origin", o.name)
 			return nil
 		}
 		if err != nil {
-			return fmt.Errorf("load meta for block %v from origin bucket: %w", id.String(), err)
+			return fmt.Errorf("load meta for block %v from origin bucket %v: %w", id.String(), o.name, err)
+		}
+
+		blocks = append(blocks, originBlock{origin: o, meta: meta})
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("iterate over origin bucket %v: %w", o.name, err)
+	}
+
+	return blocks, nil
+}
+
+// blockCollisions returns the blocks sharing the same ID if any of them has
+// a different meta, which means they are distinct blocks that must not
+// overwrite each other in the target.
+func blockCollisions(blocks []originBlock) []originBlock {
+	for _, b := range blocks[1:] {
+		if !reflect.DeepEqual(blocks[0].meta, b.meta) {
+			return blocks
 		}
+	}
 
-		if len(meta.Thanos.Labels) == 0 {
-			// TODO(bwplotka): Allow injecting custom labels as shipper does.
-			level.Info(rs.logger).Log("msg", "block meta without Thanos external labels set. This is not allowed. Skipping.", "block_uuid", id.String())
+	return nil
+}
+
+// loadTargetCompactionSources reads the metas of all blocks in the target
+// bucket and returns, per compaction group, the source blocks that were
+// compacted into another block, mapped to the block they are part of.
+func (rs *replicationScheme) loadTargetCompactionSources(ctx context.Context, t *replicationTarget) (map[string]map[ulid.ULID]ulid.ULID, error) {
+	sources := map[string]map[ulid.ULID]ulid.ULID{}
+
+	level.Debug(rs.logger).Log("msg", "scanning target bucket for compacted blocks", "target", t.name)
+
+	if err := t.bkt.Iter(ctx, "", func(name string) error {
+		id, ok := thanosblock.IsBlockDir(name)
+		if !ok {
 			return nil
 		}
 
-		level.Debug(rs.logger).Log("msg", "adding block to available blocks", "block_uuid", id.String())
+		meta, metaNonExistentOrPartial, err := loadMeta(ctx, t.bkt, id)
+		if metaNonExistentOrPartial {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("load meta for block %v from target bucket: %w", id.String(), err)
+		}
+
+		group := compact.GroupKey(meta.Thanos)
+
+		for _, source := range meta.BlockMeta.Compaction.Sources {
+			if source == id {
+				continue
+			}
+
+			if _, ok := sources[group]; !ok {
+				sources[group] = map[ulid.ULID]ulid.ULID{}
+			}
 
-		availableBlocks = append(availableBlocks, meta)
+			sources[group][source] = id
+		}
 
 		return nil
 	}); err != nil {
-		return fmt.Errorf("iterate over origin bucket: %w", err)
+		return nil, fmt.Errorf("iterate over target bucket: %w", err)
 	}
 
-	candidateBlocks := []*metadata.Meta{}
+	return sources, nil
+}
 
-	for _, b := range availableBlocks {
-		if rs.blockFilter(b) {
-			level.Debug(rs.logger).Log("msg", "adding block to candidate blocks", "block_uuid", b.BlockMeta.ULID.String())
-			candidateBlocks = append(candidateBlocks, b)
-		}
+// candidateBlock is a block selected for replication to the given targets.
+type candidateBlock struct {
+	originBlock
+
+	targets []*replicationTarget
+}
+
+// blockReplication is a single block handed to a replication worker. It is
+// chained to the previous block of the same compaction group, so that the
+// meta file of a block is never uploaded to a target before the ones of older
+// blocks.
+type blockReplication struct {
+	candidateBlock
+
+	prev *blockReplication
+	// relaxOrdering ignores the failure of older blocks of the same group.
+	relaxOrdering bool
+
+	// done holds a channel per target, closed once the replication to the
+	// target finished, so that a slow target does not hold up the others.
+	// errs holds the result of every finished target.
+	mtx  sync.Mutex
+	done map[string]chan struct{}
+	errs map[string]error
+}
+
+func newBlockReplication(b candidateBlock, prev *blockReplication, relaxOrdering bool) *blockReplication {
+	br := &blockReplication{
+		candidateBlock: b,
+		prev:           prev,
+		relaxOrdering:  relaxOrdering,
+		done:           make(map[string]chan struct{}, len(b.targets)),
+		errs:           make(map[string]error, len(b.targets)),
 	}
 
-	// In order to prevent races in compactions by the target environment, we
-	// need to replicate oldest start timestamp first.
-	sort.Slice(candidateBlocks, func(i, j int) bool {
-		return candidateBlocks[i].BlockMeta.MinTime < candidateBlocks[j].BlockMeta.MinTime
-	})
+	for _, t := range b.targets {
+		br.done[t.name] = make(chan struct{})
+	}
+
+	return br
+}
+
+// finish records the result of the replication to the target. Only the first
+// result of a target is recorded.
+func (br *blockReplication) finish(t *replicationTarget, err error) {
+	br.mtx.Lock()
+	defer br.mtx.Unlock()
+
+	if _, ok := br.errs[t.name]; ok {
+		return
+	}
+
+	br.errs[t.name] = err
+	close(br.done[t.name])
+}
+
+// result returns the result of the replication to a finished target.
+func (br *blockReplication) result(target string) error {
+	br.mtx.Lock()
+	defer br.mtx.Unlock()
+
+	return br.errs[target]
+}
+
+// errOlderBlockFailed is returned for blocks not replicated as an older block
+// of the same group failed. They are blocked rather than failed themselves.
+var errOlderBlockFailed = errors.New("older block of the same group was not replicated")
+
+// waitForOlder blocks until the previous block of the same group replicated
+// to the target finished and returns errOlderBlockFailed if it did not
+// succeed.
+func (br *blockReplication) waitForOlder(ctx context.Context, t *replicationTarget) error {
+	for prev := br.prev; prev != nil; prev = prev.prev {
+		// Blocks not replicated to the target, e.g. because they are already
+		// compacted in it, do not need to be waited for.
+		done, ok := prev.done[t.name]
+		if !ok {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+		}
+
+		// Neither do quarantined blocks, nor failed blocks if the ordering is
+		// relaxed.
+		err := prev.result(t.name)
+		if err == errBlockQuarantined || (err != nil && br.relaxOrdering) {
+			continue
+		}
 
-	for _, b := range candidateBlocks {
-		if err := rs.ensureBlockIsReplicated(ctx, b.BlockMeta.ULID); err != nil {
-			return fmt.Errorf("ensure block %v is replicated: %w", b.BlockMeta.ULID.String(), err)
+		if err != nil {
+			return errOlderBlockFailed
 		}
+
+		return nil
 	}
 
 	return nil
 }
 
+// replicateBlocks replicates the given blocks, which have to be sorted oldest
+// first, using up to blockConcurrency workers. A target failing to replicate a
+// block is skipped for the remaining blocks, while replication to the other
+// targets goes on. No further blocks are started once all targets failed. In
+// continue on error mode, the failed block is recorded instead and the target
+// keeps replicating the remaining blocks.
+func (rs *replicationScheme) replicateBlocks(ctx context.Context, blocks []candidateBlock) error {
+	var wg sync.WaitGroup
+
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	work := make(chan *blockReplication)
+
+	for i := 0; i < rs.opts.blockConcurrency; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for br := range work {
+				rs.metrics.blocksInFlight.Inc()
+				errs := rs.ensureBlockIsReplicated(workCtx, br.origin, br.meta, rs.activeTargets(br.targets), br.waitForOlder, br.finish)
+				rs.metrics.blocksInFlight.Dec()
+
+				// Targets that failed since the block was dispatched are
+				// recorded as failed, so newer blocks do not overtake it.
+				for _, t := range br.targets {
+					err, ok := errs[t.name]
+					if !ok {
+						err = errTargetFailed
+					}
+
+					br.finish(t, err)
+				}
+
+				for _, t := range br.targets {
+					err := br.result(t.name)
+					if err == nil || err == errTargetFailed || err == errBlockQuarantined {
+						continue
+					}
+
+					// Only the older block failing is counted, the target
+					// fails or the failure is recorded for it.
+					if err == errOlderBlockFailed {
+						level.Warn(rs.logger).Log("msg", "block waits for an older block of the same group that failed, retrying in the next run", "block_uuid", br.meta.BlockMeta.ULID.String(), "target", t.name)
+						continue
+					}
+
+					rs.metrics.targetBlockFailures.WithLabelValues(br.origin.name, t.name).Inc()
+
+					if rs.opts.continueOnError.enabled {
+						rs.failBlock(t, br.meta.BlockMeta.ULID, err)
+						continue
+					}
+
+					if rs.failTarget(t, fmt.Errorf("ensure block %v is replicated: %w", br.meta.BlockMeta.ULID.String(), err)) {
+						cancel()
+					}
+				}
+			}
+		}()
+	}
+
+	// Blocks are dispatched oldest first, therefore the previous block of a
+	// group has always been picked up by a worker before its successor.
+	latest := map[string]*blockReplication{}
+	dispatched := make([]*blockReplication, 0, len(blocks))
+
+dispatch:
+	for _, b := range blocks {
+		targets := rs.activeTargets(b.targets)
+		if len(targets) == 0 {
+			continue
+		}
+
+		group := compact.GroupKey(b.meta.Thanos)
+		br := newBlockReplication(candidateBlock{originBlock: b.originBlock, targets: targets}, latest[group], rs.opts.continueOnError.relaxOrdering)
+		latest[group] = br
+
+		select {
+		case <-workCtx.Done():
+			break dispatch
+		case work <- br:
+			dispatched = append(dispatched, br)
+		}
+	}
+
+	close(work)
+	wg.Wait()
+
+	results := make(map[ulid.ULID]map[string]error, len(dispatched))
+	for _, br := range dispatched {
+		results[br.meta.BlockMeta.ULID] = br.errs
+	}
+
+	rs.updateBlockedBlocks(results)
+	rs.updateLagMetrics(blocks, results)
+
+	return ctx.Err()
+}
+
+var errTargetFailed = errors.New("target failed earlier in this run")
+
 // ensureBlockIsReplicated ensures that a block present in the origin bucket is
-// present in the target bucket.
-func (rs *replicationScheme) ensureBlockIsReplicated(ctx context.Context, id ulid.ULID) error {
+// present in the given targets. The meta file is only uploaded to a target
+// after waitForOlder returned successfully for it. Targets wait for older
+// blocks and upload the meta file independently of each other, finished is
+// called for every target whose result is known before the others finished.
+// It returns the result of every target, a target failing does not prevent
+// replicating to the others.
+func (rs *replicationScheme) ensureBlockIsReplicated(ctx context.Context, origin *replicationOrigin, meta *metadata.Meta, targets []*replicationTarget, waitForOlder func(context.Context, *replicationTarget) error, finished func(*replicationTarget, error)) map[string]error {
+	id := meta.BlockMeta.ULID
 	blockID := id.String()
-	chunksDir := path.Join(blockID, thanosblock.ChunksDirname)
-	indexFile := path.Join(blockID, thanosblock.IndexFilename)
+	resolution := resolutionLabel(meta)
 	metaFile := path.Join(blockID, thanosblock.MetaFilename)
 
-	level.Debug(rs.logger).Log("msg", "ensuring block is replicated", "block_uuid", blockID)
+	errs := make(map[string]error, len(targets))
+	start := time.Now()
+
+	failAll := func(targets []*replicationTarget, err error) map[string]error {
+		for _, t := range targets {
+			errs[t.name] = err
+		}
+
+		return errs
+	}
+
+	level.Debug(rs.logger).Log("msg", "ensuring block is replicated", "block_uuid", blockID, "origin", origin.name)
 
-	originMetaFile, err := rs.fromBkt.Get(ctx, metaFile)
+	expectedMetaFileContent, err := rs.expectedMetaContent(ctx, origin, metaFile)
 	if err != nil {
-		return fmt.Errorf("get meta file from origin bucket: %w", err)
+		return failAll(targets, err)
 	}
 
-	defer runutil.CloseWithLogOnErr(rs.logger, originMetaFile, "close original meta file")
+	var pending, reconcile []*replicationTarget
+
+	for _, t := range targets {
+		replicated, err := rs.isMetaReplicated(ctx, t, metaFile, expectedMetaFileContent)
+		if err != nil {
+			errs[t.name] = err
+			continue
+		}
 
-	targetMetaFile, err := rs.toBkt.Get(ctx, metaFile)
-	if targetMetaFile != nil {
-		defer runutil.CloseWithLogOnErr(rs.logger, targetMetaFile, "close target meta file")
+		switch {
+		case !replicated:
+			pending = append(pending, t)
+		case rs.opts.deepReconcile:
+			reconcile = append(reconcile, t)
+		default:
+			level.Debug(rs.logger).Log("msg", "skipping block as already replicated", "block_uuid", blockID, "target", t.name)
+			rs.metrics.blocksAlreadyReplicated.WithLabelValues(resolution, origin.name, t.name).Inc()
+			errs[t.name] = nil
+		}
 	}
 
-	if err != nil && !rs.toBkt.IsObjNotFoundErr(err) && err != io.EOF {
-		return fmt.Errorf("get meta file from target bucket: %w", err)
+	if len(pending) == 0 && len(reconcile) == 0 {
+		return errs
 	}
 
-	originMetaFileContent, err := ioutil.ReadAll(originMetaFile)
+	// Only blocks replicated for the first time are checked. Blocks already
+	// replicated to a target are neither downloaded again on every deep
+	// reconcile nor quarantined.
+	if rs.opts.indexHealthCheck.enabled && len(pending) > 0 {
+		if err := rs.checkIndexHealth(ctx, origin, meta); err != nil {
+			failAll(pending, err)
+			pending = nil
+
+			if len(reconcile) == 0 {
+				return errs
+			}
+		}
+	}
+
+	objectTargets := append(append([]*replicationTarget{}, pending...), reconcile...)
+
+	objectNames, err := rs.listBlockObjects(ctx, origin, id)
 	if err != nil {
-		return fmt.Errorf("read origin meta file: %w", err)
+		return failAll(objectTargets, err)
+	}
+
+	// The meta file must only be uploaded once all other objects have been
+	// successfully replicated.
+	copied, copiedBytes, objectErrs := rs.replicateObjects(ctx, origin, objectNames, objectTargets)
+
+	for _, t := range objectTargets {
+		rs.metrics.objectsReplicated.WithLabelValues(resolution, origin.name, t.name).Add(float64(copied[t.name]))
+		errs[t.name] = objectErrs[t.name]
+	}
+
+	for _, t := range reconcile {
+		if errs[t.name] == nil {
+			rs.reconciledBlock(id, t, copied[t.name])
+		}
+	}
+
+	metaTargets := make([]*replicationTarget, 0, len(pending))
+
+	for _, t := range pending {
+		if errs[t.name] == nil {
+			metaTargets = append(metaTargets, t)
+		}
+	}
+
+	// Targets not uploading the meta file are done, so that newer blocks do
+	// not wait for the other targets to upload theirs.
+	for _, t := range targets {
+		if err, ok := errs[t.name]; ok && !containsTarget(metaTargets, t) {
+			finished(t, err)
+		}
+	}
+
+	// objectsDuration is the time it took to replicate the objects, the time
+	// waiting for older blocks is not part of the replication duration.
+	objectsDuration := time.Since(start)
+
+	var (
+		wg  sync.WaitGroup
+		mtx sync.Mutex
+		// metaDuration is the longest meta file upload.
+		metaDuration time.Duration
+		replicated   bool
+	)
+
+	for _, t := range metaTargets {
+		wg.Add(1)
+
+		go func(t *replicationTarget) {
+			defer wg.Done()
+
+			rs.metrics.blocksWaitingForOld.Inc()
+			err := waitForOlder(ctx, t)
+			rs.metrics.blocksWaitingForOld.Dec()
+
+			var uploadDuration time.Duration
+
+			if err != nil {
+				if err != errOlderBlockFailed {
+					err = fmt.Errorf("wait for older blocks: %w", err)
+				}
+			} else {
+				uploadStart := time.Now()
+				err = rs.uploadMetaFile(ctx, origin, t, metaFile, expectedMetaFileContent, resolution)
+				uploadDuration = time.Since(uploadStart)
+			}
+
+			mtx.Lock()
+			defer mtx.Unlock()
+
+			errs[t.name] = err
+			finished(t, err)
+
+			if err == nil {
+				replicated = true
+
+				if uploadDuration > metaDuration {
+					metaDuration = uploadDuration
+				}
+			}
+		}(t)
+	}
+
+	wg.Wait()
+
+	if replicated {
+		rs.metrics.blockDuration.WithLabelValues(origin.name).Observe((objectsDuration + metaDuration).Seconds())
+		rs.metrics.blockSize.WithLabelValues(origin.name).Observe(float64(copiedBytes + int64(len(expectedMetaFileContent))))
 	}
 
-	if targetMetaFile != nil && !rs.toBkt.IsObjNotFoundErr(err) {
-		targetMetaFileContent, err := ioutil.ReadAll(targetMetaFile)
+	return errs
+}
+
+// uploadMetaFile uploads the meta file of a block to the target, which makes
+// the block visible in it.
+func (rs *replicationScheme) uploadMetaFile(ctx context.Context, origin *replicationOrigin, t *replicationTarget, metaFile string, content []byte, resolution string) error {
+	level.Debug(rs.logger).Log("msg", "replicating meta file", "object", metaFile, "target", t.name)
+
+	if err := rs.retry(ctx, operationUpload, func() error {
+		return t.bkt.Upload(ctx, metaFile, bytes.NewReader(content))
+	}); err != nil {
+		return fmt.Errorf("upload meta file: %w", err)
+	}
+
+	rs.metrics.targetBytesWritten.WithLabelValues(t.name).Add(float64(len(content)))
+	rs.metrics.blocksReplicated.WithLabelValues(resolution, origin.name, t.name).Inc()
+
+	return nil
+}
+
+func containsTarget(targets []*replicationTarget, t *replicationTarget) bool {
+	for _, other := range targets {
+		if other == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// expectedMetaContent returns the content of the meta file of a block as it is
+// written to the targets, which may differ from the origin one, e.g. due to
+// injected external labels.
+func (rs *replicationScheme) expectedMetaContent(ctx context.Context, origin *replicationOrigin, metaFile string) ([]byte, error) {
+	var originMetaFileContent []byte
+
+	if err := rs.retry(ctx, operationGet, func() error {
+		originMetaFile, err := origin.bkt.Get(ctx, metaFile)
 		if err != nil {
-			return fmt.Errorf("read target meta file: %w", err)
+			return fmt.Errorf("get meta file from origin bucket %v: %w", origin.name, err)
 		}
 
-		if bytes.Equal(originMetaFileContent, targetMetaFileContent) {
-			// If the origin meta file content and target meta file content is
-			// equal, we know we have already successfully replicated
-			// previously.
-			level.Debug(rs.logger).Log("msg", "skipping block as already replicated", "block_uuid", id.String())
-			rs.metrics.blocksAlreadyReplicated.Inc()
+		defer runutil.CloseWithLogOnErr(rs.logger, originMetaFile, "close original meta file")
 
-			return nil
+		originMetaFileContent, err = ioutil.ReadAll(originMetaFile)
+		if err != nil {
+			return fmt.Errorf("read origin meta file: %w", err)
 		}
+
+		return nil
+	}); err != nil {
+		return nil, err
 	}
 
-	if err := rs.fromBkt.Iter(ctx, chunksDir, func(objectName string) error {
-		err := rs.ensureObjectReplicated(ctx, objectName)
+	content, err := rs.targetMetaContent(originMetaFileContent)
+	if err != nil {
+		return nil, fmt.Errorf("rewrite meta file: %w", err)
+	}
+
+	return content, nil
+}
+
+// isMetaReplicated returns whether the meta file in the target bucket has the
+// expected content, in which case the block was already replicated
+// successfully.
+func (rs *replicationScheme) isMetaReplicated(ctx context.Context, t *replicationTarget, metaFile string, expectedContent []byte) (bool, error) {
+	var (
+		targetMetaFileContent []byte
+		found                 bool
+	)
+
+	if err := rs.retry(ctx, operationGet, func() error {
+		targetMetaFile, err := t.bkt.Get(ctx, metaFile)
+		if targetMetaFile != nil {
+			defer runutil.CloseWithLogOnErr(rs.logger, targetMetaFile, "close target meta file")
+		}
+
+		if err != nil && !t.bkt.IsObjNotFoundErr(err) && err != io.EOF {
+			return fmt.Errorf("get meta file from target bucket: %w", err)
+		}
+
+		if targetMetaFile == nil || t.bkt.IsObjNotFoundErr(err) {
+			found = false
+			return nil
+		}
+
+		targetMetaFileContent, err = ioutil.ReadAll(targetMetaFile)
 		if err != nil {
-			return fmt.Errorf("replicate object %v: %w", objectName, err)
+			return fmt.Errorf("read target meta file: %w", err)
 		}
 
+		found = true
+
 		return nil
 	}); err != nil {
-		return err
+		return false, err
 	}
 
-	if err := rs.ensureObjectReplicated(ctx, indexFile); err != nil {
-		return fmt.Errorf("replicate index file: %w", err)
+	if !found {
+		return false, nil
 	}
 
-	level.Debug(rs.logger).Log("msg", "replicating meta file", "object", metaFile)
+	return sameMetaContent(expectedContent, targetMetaFileContent), nil
+}
 
-	if err := rs.toBkt.Upload(ctx, metaFile, bytes.NewReader(originMetaFileContent)); err != nil {
-		return fmt.Errorf("upload meta file: %w", err)
+// reconciledBlock records the deep reconcile of a block whose meta file was
+// already replicated, for which the given number of missing or, depending on
+// the object verification mode, mismatching objects were repaired.
+func (rs *replicationScheme) reconciledBlock(id ulid.ULID, t *replicationTarget, repaired int64) {
+	atomic.AddInt64(&rs.reconciledBlocks, 1)
+	rs.metrics.deepReconcileBlocksChecked.Inc()
+
+	if repaired > 0 {
+		level.Warn(rs.logger).Log("msg", "repaired already replicated block", "block_uuid", id.String(), "target", t.name, "repaired_objects", repaired)
+		atomic.AddInt64(&rs.repairedBlocks, 1)
+		rs.metrics.deepReconcileBlocksRepaired.Inc()
+		rs.metrics.deepReconcileObjectsRepaired.Add(float64(repaired))
 	}
+}
+
+// listBlockObjects returns the names of all objects of a block in the origin
+// bucket, except for the meta file.
+func (rs *replicationScheme) listBlockObjects(ctx context.Context, origin *replicationOrigin, id ulid.ULID) ([]string, error) {
+	blockID := id.String()
+	chunksDir := path.Join(blockID, thanosblock.ChunksDirname)
+	indexFile := path.Join(blockID, thanosblock.IndexFilename)
 
-	rs.metrics.blocksReplicated.Inc()
+	objectNames := []string{}
 
-	return nil
+	if err := origin.bkt.Iter(ctx, chunksDir, func(objectName string) error {
+		objectNames = append(objectNames, objectName)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("iterate over chunks of block %v: %w", blockID, err)
+	}
+
+	return append(objectNames, indexFile), nil
+}
+
+// replicateObjects replicates the given objects to the targets using up to
+// objectConcurrency parallel copies. It returns per target how many objects
+// had to be copied, the total size of the copied objects, as well as the
+// first error encountered, after which no further objects are replicated to
+// that target.
+func (rs *replicationScheme) replicateObjects(ctx context.Context, origin *replicationOrigin, objectNames []string, targets []*replicationTarget) (map[string]int64, int64, map[string]error) {
+	var (
+		wg          sync.WaitGroup
+		mtx         sync.Mutex
+		copied      = map[string]int64{}
+		copiedBytes int64
+		errs        = map[string]error{}
+	)
+
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// remaining returns the targets that did not fail yet.
+	remaining := func() []*replicationTarget {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		ts := make([]*replicationTarget, 0, len(targets))
+
+		for _, t := range targets {
+			if _, ok := errs[t.name]; !ok {
+				ts = append(ts, t)
+			}
+		}
+
+		return ts
+	}
+
+	work := make(chan string)
+
+	for i := 0; i < rs.opts.objectConcurrency && i < len(objectNames); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for objectName := range work {
+				ts := remaining()
+				if len(ts) == 0 {
+					continue
+				}
+
+				rs.metrics.objectsInFlight.Inc()
+				replicatedTo, size, objectErrs := rs.ensureObjectReplicated(workCtx, origin, objectName, ts)
+				rs.metrics.objectsInFlight.Dec()
+
+				mtx.Lock()
+
+				for _, t := range replicatedTo {
+					copied[t.name]++
+				}
+
+				copiedBytes += size
+
+				for name, err := range objectErrs {
+					if _, ok := errs[name]; !ok {
+						errs[name] = fmt.Errorf("replicate object %v: %w", objectName, err)
+					}
+				}
+
+				allFailed := len(errs) == len(targets)
+
+				mtx.Unlock()
+
+				if allFailed {
+					cancel()
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for _, objectName := range objectNames {
+		select {
+		case <-workCtx.Done():
+			break dispatch
+		case work <- objectName:
+		}
+	}
+
+	close(work)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		for _, t := range targets {
+			if _, ok := errs[t.name]; !ok {
+				errs[t.name] = err
+			}
+		}
+	}
+
+	return copied, copiedBytes, errs
 }
 
-// ensureBlockIsReplicated ensures that an object present in the origin bucket
-// is present in the target bucket.
-func (rs *replicationScheme) ensureObjectReplicated(ctx context.Context, objectName string) error {
+// ensureObjectReplicated ensures that an object present in the origin bucket
+// is present in the given targets. The object is read once from the origin
+// bucket and uploaded to all targets missing it. It returns the targets the
+// object had to be copied to, the size of the object if copied and the errors
+// of the targets that failed.
+func (rs *replicationScheme) ensureObjectReplicated(ctx context.Context, origin *replicationOrigin, objectName string, targets []*replicationTarget) ([]*replicationTarget, int64, map[string]error) {
 	level.Debug(rs.logger).Log("msg", "ensuring object is replicated", "object", objectName)
 
-	exists, err := rs.toBkt.Exists(ctx, objectName)
+	errs := map[string]error{}
+	missing := make([]*replicationTarget, 0, len(targets))
+	originDigest := rs.originDigest(ctx, origin, objectName)
+
+	for _, t := range targets {
+		replicated, err := rs.isObjectReplicated(ctx, t, objectName, originDigest)
+		if err != nil {
+			errs[t.name] = err
+			continue
+		}
+
+		// skip if already replicated
+		if replicated {
+			rs.opts.objectSizes.replicated(objectName, t.name)
+			level.Debug(rs.logger).Log("msg", "skipping object as already replicated", "object", objectName, "target", t.name)
+			continue
+		}
+
+		missing = append(missing, t)
+	}
+
+	if len(missing) == 0 {
+		return nil, 0, errs
+	}
+
+	level.Debug(rs.logger).Log("msg", "object not present in target buckets, replicating", "object", objectName, "targets", len(missing))
+
+	var (
+		replicated = make([]*replicationTarget, 0, len(missing))
+		size       int64
+		start      = time.Now()
+	)
+
+	defer func() {
+		if len(replicated) > 0 {
+			rs.metrics.objectDuration.WithLabelValues(origin.name).Observe(time.Since(start).Seconds())
+			rs.metrics.objectSize.WithLabelValues(origin.name).Observe(float64(size))
+		}
+	}()
+
+	// An upload consumes the origin stream, so every upload attempt reads
+	// the object again, for the targets that failed with a transient error
+	// only.
+	for attempt := 1; len(missing) > 0; attempt++ {
+		if attempt > 1 {
+			backoff := rs.opts.retry.backoff(attempt - 1)
+			level.Warn(rs.logger).Log("msg", "retrying object upload", "object", objectName, "targets", len(missing), "attempt", attempt-1, "backoff", backoff)
+			rs.metrics.operationRetries.WithLabelValues(operationUpload).Add(float64(len(missing)))
+
+			select {
+			case <-ctx.Done():
+				for _, t := range missing {
+					errs[t.name] = fmt.Errorf("upload %v to target bucket: %w", objectName, ctx.Err())
+				}
+
+				return replicated, size, errs
+			case <-time.After(backoff):
+			}
+		}
+
+		var r io.ReadCloser
+
+		if err := rs.retry(ctx, operationGet, func() (err error) {
+			r, err = origin.bkt.Get(ctx, objectName)
+			return err
+		}); err != nil {
+			for _, t := range missing {
+				errs[t.name] = fmt.Errorf("get %v from origin bucket %v: %w", objectName, origin.name, err)
+			}
+
+			return replicated, size, errs
+		}
+
+		cr := &countingReader{r: r}
+		uploadErrs, written := uploadToTargets(ctx, objectName, cr, missing)
+		runutil.CloseWithLogOnErr(rs.logger, r, "close object reader")
+
+		rs.metrics.originBytesRead.WithLabelValues(origin.name).Add(float64(cr.n))
+		for i, t := range missing {
+			rs.metrics.targetBytesWritten.WithLabelValues(t.name).Add(float64(written[i]))
+		}
+
+		retry := make([]*replicationTarget, 0, len(missing))
+
+		for i, err := range uploadErrs {
+			t := missing[i]
+
+			if err == nil {
+				// A successful upload read the whole object.
+				size = cr.n
+				rs.opts.objectSizes.set(objectName, size)
+				rs.opts.objectSizes.replicated(objectName, t.name)
+
+				level.Info(rs.logger).Log("msg", "object replicated", "object", objectName, "target", t.name)
+				replicated = append(replicated, t)
+
+				continue
+			}
+
+			if attempt < rs.opts.retry.attempts && isRetriable(err) && ctx.Err() == nil {
+				retry = append(retry, t)
+				continue
+			}
+
+			errs[t.name] = fmt.Errorf("upload %v to target bucket: %w", objectName, err)
+		}
+
+		missing = retry
+	}
+
+	return replicated, size, errs
+}
+
+// originDigest returns a function digesting the origin object on its first
+// call only, no matter the number of targets to verify.
+func (rs *replicationScheme) originDigest(ctx context.Context, origin *replicationOrigin, objectName string) func() (objectDigest, error) {
+	var digest *objectDigest
+
+	return func() (objectDigest, error) {
+		if digest != nil {
+			return *digest, nil
+		}
+
+		var d objectDigest
+
+		if err := rs.retry(ctx, operationGet, func() (err error) {
+			d, _, err = rs.digestObject(ctx, origin.bkt, objectName, rs.opts.objectVerification == objectVerificationHash)
+			return err
+		}); err != nil {
+			return objectDigest{}, fmt.Errorf("read %v from origin bucket %v: %w", objectName, origin.name, err)
+		}
+
+		digest = &d
+		rs.opts.objectSizes.set(objectName, d.size)
+		rs.metrics.originBytesRead.WithLabelValues(origin.name).Add(float64(d.size))
+
+		return d, nil
+	}
+}
+
+// isObjectReplicated returns whether the object is present in the target
+// bucket and, depending on the object verification mode, whether its content
+// matches the object in the origin bucket.
+func (rs *replicationScheme) isObjectReplicated(ctx context.Context, t *replicationTarget, objectName string, originDigest func() (objectDigest, error)) (bool, error) {
+	if rs.opts.objectVerification == objectVerificationExists {
+		var exists bool
+
+		if err := rs.retry(ctx, operationExists, func() (err error) {
+			exists, err = t.bkt.Exists(ctx, objectName)
+			return err
+		}); err != nil {
+			return false, fmt.Errorf("check if %v exists in target bucket: %w", objectName, err)
+		}
+
+		return exists, nil
+	}
+
+	withHash := rs.opts.objectVerification == objectVerificationHash
+
+	var (
+		target objectDigest
+		found  bool
+	)
+
+	if err := rs.retry(ctx, operationGet, func() (err error) {
+		target, found, err = rs.digestObject(ctx, t.bkt, objectName, withHash)
+		return err
+	}); err != nil {
+		return false, fmt.Errorf("read %v from target bucket: %w", objectName, err)
+	}
+
+	if !found {
+		return false, nil
+	}
+
+	origin, err := originDigest()
 	if err != nil {
-		return fmt.Errorf("check if %v exists in target bucket: %w", objectName, err)
+		return false, err
 	}
 
-	// skip if already exists
-	if exists {
-		level.Debug(rs.logger).Log("msg", "skipping object as already replicated", "object", objectName)
-		return nil
+	rs.metrics.objectsVerified.Inc()
+
+	if reason := origin.mismatch(target); reason != "" {
+		level.Warn(rs.logger).Log("msg", "object in target bucket does not match origin, replicating again", "object", objectName, "target", t.name, "reason", reason, "origin_size", origin.size, "target_size", target.size)
+		rs.metrics.objectsMismatched.WithLabelValues(reason).Inc()
+
+		return false, nil
 	}
 
-	level.Debug(rs.logger).Log("msg", "object not present in target bucket, replicating", "object", objectName)
+	return true, nil
+}
+
+// objectDigest summarizes the content of an object.
+type objectDigest struct {
+	size int64
+	hash []byte
+}
+
+// mismatch returns the reason why the digests differ, or an empty string if
+// they are equal.
+func (d objectDigest) mismatch(other objectDigest) string {
+	if d.size != other.size {
+		return "size"
+	}
+
+	if !bytes.Equal(d.hash, other.hash) {
+		return "hash"
+	}
+
+	return ""
+}
+
+// digestObject streams the given object and returns its digest, as well as
+// whether the object was found at all. The SHA-256 is only computed if
+// withHash is set.
+func (rs *replicationScheme) digestObject(ctx context.Context, bucket objstore.BucketReader, objectName string, withHash bool) (objectDigest, bool, error) {
+	r, err := bucket.Get(ctx, objectName)
+	if bucket.IsObjNotFoundErr(err) {
+		return objectDigest{}, false, nil
+	}
 
-	r, err := rs.fromBkt.Get(ctx, objectName)
 	if err != nil {
-		return fmt.Errorf("get %v from origin bucket: %w", objectName, err)
+		return objectDigest{}, false, fmt.Errorf("get object: %w", err)
 	}
 
-	defer r.Close()
+	defer runutil.CloseWithLogOnErr(rs.logger, r, "close object reader")
+
+	var (
+		w = ioutil.Discard
+		h hash.Hash
+	)
 
-	if err = rs.toBkt.Upload(ctx, objectName, r); err != nil {
-		return fmt.Errorf("upload %v to target bucket: %w", objectName, err)
+	if withHash {
+		h = sha256.New()
+		w = h
 	}
 
-	level.Info(rs.logger).Log("msg", "object replicated", "object", objectName)
-	rs.metrics.objectsReplicated.Inc()
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return objectDigest{}, false, fmt.Errorf("read object: %w", err)
+	}
 
-	return nil
+	d := objectDigest{size: n}
+	if h != nil {
+		d.hash = h.Sum(nil)
+	}
+
+	return d, true, nil
 }
 
 // loadMeta loads the meta.json from the origin bucket and returns the meta
@@ -4,21 +4,32 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/relabel"
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/prometheus/prometheus/tsdb/labels"
 	"github.com/prometheus/tsdb/testutil"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/compact"
+	thanosmodel "github.com/thanos-io/thanos/pkg/model"
 	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/objstore/inmem"
 )
@@ -58,13 +69,39 @@ func testMeta(ulid ulid.ULID) *metadata.Meta {
 	}
 }
 
+// testBlockFilter returns a filter selecting the raw, uncompacted blocks with
+// the labels of testMeta.
+func testBlockFilter(logger log.Logger, filtered *prometheus.CounterVec) blockFilterFunc {
+	return NewBlockFilter(
+		logger,
+		filtered,
+		labels.Selector{labels.NewEqualMatcher("test-labelname", "test-labelvalue")},
+		levelSet{{min: int64(compact.ResolutionLevelRaw), max: int64(compact.ResolutionLevelRaw)}},
+		levelSet{{min: 1, max: 1}},
+		timeRange{},
+		sourceFilter{},
+	).FilterReason
+}
+
+func testTime(t *testing.T, s string) *thanosmodel.TimeOrDurationValue {
+	var tdv thanosmodel.TimeOrDurationValue
+	testutil.Ok(t, tdv.Set(s))
+
+	return &tdv
+}
+
 //nolint:funlen
 func TestReplicationSchemeAll(t *testing.T) {
 	var cases = []struct {
-		name     string
-		selector labels.Selector
-		prepare  func(ctx context.Context, t *testing.T, originBucket, targetBucket objstore.Bucket)
-		assert   func(ctx context.Context, t *testing.T, originBucket, targetBucket *inmem.Bucket)
+		name        string
+		selector    labels.Selector
+		resolutions levelSet
+		compactions levelSet
+		timeRange   timeRange
+		sources     sourceFilter
+		opts        replicationOptions
+		prepare     func(ctx context.Context, t *testing.T, originBucket, targetBucket objstore.Bucket)
+		assert      func(ctx context.Context, t *testing.T, originBucket, targetBucket *inmem.Bucket)
 	}{
 		{
 			name:    "EmptyOrigin",
@@ -243,6 +280,379 @@ func TestReplicationSchemeAll(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "MultipleResolutionsAndCompactionLevels",
+			resolutions: levelSet{
+				{min: int64(compact.ResolutionLevelRaw), max: int64(compact.ResolutionLevelRaw)},
+				{min: int64(compact.ResolutionLevel1h), max: int64(compact.ResolutionLevel1h)},
+			},
+			compactions: levelSet{{min: 1, max: 3}},
+			prepare: func(ctx context.Context, t *testing.T, originBucket, targetBucket objstore.Bucket) {
+				for i, b := range []struct {
+					resolution compact.ResolutionLevel
+					compaction int
+				}{
+					{resolution: compact.ResolutionLevelRaw, compaction: 1},
+					{resolution: compact.ResolutionLevelRaw, compaction: 3},
+					{resolution: compact.ResolutionLevelRaw, compaction: 4},
+					{resolution: compact.ResolutionLevel5m, compaction: 2},
+					{resolution: compact.ResolutionLevel1h, compaction: 2},
+				} {
+					ulid := testULID(int64(i))
+					meta := testMeta(ulid)
+					meta.Thanos.Downsample.Resolution = int64(b.resolution)
+					meta.BlockMeta.Compaction.Level = b.compaction
+
+					b, err := json.Marshal(meta)
+					testutil.Ok(t, err)
+					_ = originBucket.Upload(ctx, path.Join(ulid.String(), "meta.json"), bytes.NewReader(b))
+					_ = originBucket.Upload(ctx, path.Join(ulid.String(), "chunks", "000001"), bytes.NewReader(nil))
+					_ = originBucket.Upload(ctx, path.Join(ulid.String(), "index"), bytes.NewReader(nil))
+				}
+			},
+			assert: func(ctx context.Context, t *testing.T, originBucket, targetBucket *inmem.Bucket) {
+				objects := targetBucket.Objects()
+				testutil.Equals(t, 9, len(objects))
+
+				for _, i := range []int64{0, 1, 4} {
+					testutil.Assert(t, objects[path.Join(testULID(i).String(), "meta.json")] != nil, "block %d should have been replicated", i)
+				}
+			},
+		},
+		{
+			name: "SourceFilter",
+			sources: sourceFilter{
+				include: []metadata.SourceType{metadata.SidecarSource, metadata.ReceiveSource, metadata.CompactorRepairSource},
+				exclude: []metadata.SourceType{metadata.CompactorRepairSource},
+			},
+			prepare: func(ctx context.Context, t *testing.T, originBucket, targetBucket objstore.Bucket) {
+				for i, source := range []metadata.SourceType{
+					metadata.SidecarSource,
+					metadata.ReceiveSource,
+					metadata.CompactorSource,
+					metadata.CompactorRepairSource,
+					metadata.UnknownSource,
+				} {
+					ulid := testULID(int64(i))
+					meta := testMeta(ulid)
+					meta.Thanos.Source = source
+
+					b, err := json.Marshal(meta)
+					testutil.Ok(t, err)
+					_ = originBucket.Upload(ctx, path.Join(ulid.String(), "meta.json"), bytes.NewReader(b))
+					_ = originBucket.Upload(ctx, path.Join(ulid.String(), "chunks", "000001"), bytes.NewReader(nil))
+					_ = originBucket.Upload(ctx, path.Join(ulid.String(), "index"), bytes.NewReader(nil))
+				}
+			},
+			assert: func(ctx context.Context, t *testing.T, originBucket, targetBucket *inmem.Bucket) {
+				objects := targetBucket.Objects()
+				testutil.Equals(t, 6, len(objects))
+
+				for _, i := range []int64{0, 1} {
+					testutil.Assert(t, objects[path.Join(testULID(i).String(), "meta.json")] != nil, "block %d should have been replicated", i)
+				}
+			},
+		},
+		{
+			name: "ExcludeSource",
+			sources: sourceFilter{
+				exclude: []metadata.SourceType{metadata.CompactorRepairSource},
+			},
+			prepare: func(ctx context.Context, t *testing.T, originBucket, targetBucket objstore.Bucket) {
+				for i, source := range []metadata.SourceType{
+					metadata.SidecarSource,
+					metadata.CompactorRepairSource,
+					metadata.UnknownSource,
+				} {
+					ulid := testULID(int64(i))
+					meta := testMeta(ulid)
+					meta.Thanos.Source = source
+
+					b, err := json.Marshal(meta)
+					testutil.Ok(t, err)
+					_ = originBucket.Upload(ctx, path.Join(ulid.String(), "meta.json"), bytes.NewReader(b))
+					_ = originBucket.Upload(ctx, path.Join(ulid.String(), "chunks", "000001"), bytes.NewReader(nil))
+					_ = originBucket.Upload(ctx, path.Join(ulid.String(), "index"), bytes.NewReader(nil))
+				}
+			},
+			assert: func(ctx context.Context, t *testing.T, originBucket, targetBucket *inmem.Bucket) {
+				objects := targetBucket.Objects()
+				testutil.Equals(t, 6, len(objects))
+
+				for _, i := range []int64{0, 2} {
+					testutil.Assert(t, objects[path.Join(testULID(i).String(), "meta.json")] != nil, "block %d should have been replicated", i)
+				}
+			},
+		},
+		{
+			name: "ConsistencyDelay",
+			opts: replicationOptions{consistencyDelay: time.Hour},
+			prepare: func(ctx context.Context, t *testing.T, originBucket, targetBucket objstore.Bucket) {
+				fresh := ulid.MustNew(ulid.Now(), rand.New(rand.NewSource(1)))
+
+				for _, id := range []ulid.ULID{testULID(0), fresh} {
+					b, err := json.Marshal(testMeta(id))
+					testutil.Ok(t, err)
+					_ = originBucket.Upload(ctx, path.Join(id.String(), "meta.json"), bytes.NewReader(b))
+					_ = originBucket.Upload(ctx, path.Join(id.String(), "chunks", "000001"), bytes.NewReader(nil))
+					_ = originBucket.Upload(ctx, path.Join(id.String(), "index"), bytes.NewReader(nil))
+				}
+			},
+			assert: func(ctx context.Context, t *testing.T, originBucket, targetBucket *inmem.Bucket) {
+				objects := targetBucket.Objects()
+				testutil.Equals(t, 3, len(objects))
+				testutil.Assert(t, objects[path.Join(testULID(0).String(), "meta.json")] != nil, "old block should have been replicated")
+			},
+		},
+		{
+			name: "ConcurrentReplication",
+			opts: replicationOptions{blockConcurrency: 4, objectConcurrency: 3},
+			prepare: func(ctx context.Context, t *testing.T, originBucket, targetBucket objstore.Bucket) {
+				for i := int64(0); i < 10; i++ {
+					ulid := testULID(i)
+					meta := testMeta(ulid)
+					meta.BlockMeta.MinTime = i
+
+					b, err := json.Marshal(meta)
+					testutil.Ok(t, err)
+					_ = originBucket.Upload(ctx, path.Join(ulid.String(), "meta.json"), bytes.NewReader(b))
+					_ = originBucket.Upload(ctx, path.Join(ulid.String(), "chunks", "000001"), bytes.NewReader(nil))
+					_ = originBucket.Upload(ctx, path.Join(ulid.String(), "chunks", "000002"), bytes.NewReader(nil))
+					_ = originBucket.Upload(ctx, path.Join(ulid.String(), "chunks", "000003"), bytes.NewReader(nil))
+					_ = originBucket.Upload(ctx, path.Join(ulid.String(), "index"), bytes.NewReader(nil))
+				}
+			},
+			assert: func(ctx context.Context, t *testing.T, originBucket, targetBucket *inmem.Bucket) {
+				testutil.Equals(t, originBucket.Objects(), targetBucket.Objects())
+			},
+		},
+		{
+			name: "CorruptedTargetObject",
+			opts: replicationOptions{objectVerification: objectVerificationSize},
+			prepare: func(ctx context.Context, t *testing.T, originBucket, targetBucket objstore.Bucket) {
+				ulid := testULID(0)
+				meta := testMeta(ulid)
+
+				b, err := json.Marshal(meta)
+				testutil.Ok(t, err)
+				_ = originBucket.Upload(ctx, path.Join(ulid.String(), "meta.json"), bytes.NewReader(b))
+				_ = originBucket.Upload(ctx, path.Join(ulid.String(), "chunks", "000001"), bytes.NewReader([]byte("chunk-data")))
+				_ = originBucket.Upload(ctx, path.Join(ulid.String(), "index"), bytes.NewReader([]byte("index-data")))
+
+				_ = targetBucket.Upload(ctx, path.Join(ulid.String(), "chunks", "000001"), bytes.NewReader([]byte("chunk")))
+				_ = targetBucket.Upload(ctx, path.Join(ulid.String(), "index"), bytes.NewReader([]byte("index-data")))
+			},
+			assert: func(ctx context.Context, t *testing.T, originBucket, targetBucket *inmem.Bucket) {
+				testutil.Equals(t, originBucket.Objects(), targetBucket.Objects())
+			},
+		},
+		{
+			name: "CorruptedTargetObjectSameSize",
+			opts: replicationOptions{objectVerification: objectVerificationHash},
+			prepare: func(ctx context.Context, t *testing.T, originBucket, targetBucket objstore.Bucket) {
+				ulid := testULID(0)
+				meta := testMeta(ulid)
+
+				b, err := json.Marshal(meta)
+				testutil.Ok(t, err)
+				_ = originBucket.Upload(ctx, path.Join(ulid.String(), "meta.json"), bytes.NewReader(b))
+				_ = originBucket.Upload(ctx, path.Join(ulid.String(), "chunks", "000001"), bytes.NewReader([]byte("chunk-data")))
+				_ = originBucket.Upload(ctx, path.Join(ulid.String(), "index"), bytes.NewReader([]byte("index-data")))
+
+				_ = targetBucket.Upload(ctx, path.Join(ulid.String(), "chunks", "000001"), bytes.NewReader([]byte("chunk-dat4")))
+			},
+			assert: func(ctx context.Context, t *testing.T, originBucket, targetBucket *inmem.Bucket) {
+				testutil.Equals(t, originBucket.Objects(), targetBucket.Objects())
+			},
+		},
+		{
+			name: "DeepReconcile",
+			opts: replicationOptions{deepReconcile: true},
+			prepare: func(ctx context.Context, t *testing.T, originBucket, targetBucket objstore.Bucket) {
+				ulid := testULID(0)
+				meta := testMeta(ulid)
+
+				b, err := json.Marshal(meta)
+				testutil.Ok(t, err)
+				_ = originBucket.Upload(ctx, path.Join(ulid.String(), "meta.json"), bytes.NewReader(b))
+				_ = originBucket.Upload(ctx, path.Join(ulid.String(), "chunks", "000001"), bytes.NewReader(nil))
+				_ = originBucket.Upload(ctx, path.Join(ulid.String(), "index"), bytes.NewReader(nil))
+
+				_ = targetBucket.Upload(ctx, path.Join(ulid.String(), "meta.json"), bytes.NewReader(b))
+				_ = targetBucket.Upload(ctx, path.Join(ulid.String(), "index"), bytes.NewReader(nil))
+			},
+			assert: func(ctx context.Context, t *testing.T, originBucket, targetBucket *inmem.Bucket) {
+				testutil.Equals(t, originBucket.Objects(), targetBucket.Objects())
+			},
+		},
+		{
+			name: "SkipCompactedInTarget",
+			opts: replicationOptions{skipCompactedInTarget: true},
+			prepare: func(ctx context.Context, t *testing.T, originBucket, targetBucket objstore.Bucket) {
+				source := testULID(0)
+				meta := testMeta(source)
+
+				b, err := json.Marshal(meta)
+				testutil.Ok(t, err)
+				_ = originBucket.Upload(ctx, path.Join(source.String(), "meta.json"), bytes.NewReader(b))
+				_ = originBucket.Upload(ctx, path.Join(source.String(), "chunks", "000001"), bytes.NewReader(nil))
+				_ = originBucket.Upload(ctx, path.Join(source.String(), "index"), bytes.NewReader(nil))
+
+				compacted := testULID(1)
+				meta = testMeta(compacted)
+				meta.BlockMeta.Compaction.Level = 2
+				meta.BlockMeta.Compaction.Sources = []ulid.ULID{source, testULID(2)}
+
+				b, err = json.Marshal(meta)
+				testutil.Ok(t, err)
+				_ = targetBucket.Upload(ctx, path.Join(compacted.String(), "meta.json"), bytes.NewReader(b))
+			},
+			assert: func(ctx context.Context, t *testing.T, originBucket, targetBucket *inmem.Bucket) {
+				expected := 1
+				got := len(targetBucket.Objects())
+				if got != expected {
+					t.Fatalf("TargetBucket should only have the compacted block. Got %d but expected %d objects.", got, expected)
+				}
+			},
+		},
+		{
+			name: "InjectLabels",
+			opts: replicationOptions{injectLabels: labels.FromStrings("test-labelname", "test-labelvalue")},
+			prepare: func(ctx context.Context, t *testing.T, originBucket, targetBucket objstore.Bucket) {
+				ulid := testULID(0)
+				meta := testMeta(ulid)
+				meta.Thanos.Labels = nil
+
+				b, err := json.Marshal(meta)
+				testutil.Ok(t, err)
+				_ = originBucket.Upload(ctx, path.Join(ulid.String(), "meta.json"), bytes.NewReader(b))
+				_ = originBucket.Upload(ctx, path.Join(ulid.String(), "chunks", "000001"), bytes.NewReader(nil))
+				_ = originBucket.Upload(ctx, path.Join(ulid.String(), "index"), bytes.NewReader(nil))
+			},
+			assert: func(ctx context.Context, t *testing.T, originBucket, targetBucket *inmem.Bucket) {
+				if len(targetBucket.Objects()) != 3 {
+					t.Fatal("TargetBucket should have one block made up of three objects replicated.")
+				}
+
+				var meta replicatedMeta
+				testutil.Ok(t, json.Unmarshal(targetBucket.Objects()[path.Join(testULID(0).String(), "meta.json")], &meta))
+				testutil.Equals(t, map[string]string{"test-labelname": "test-labelvalue"}, meta.Thanos.Labels)
+				testutil.Assert(t, !meta.Replication.Time.IsZero(), "replication time should be recorded")
+				meta.Replication.Time = time.Time{}
+				testutil.Equals(t, &replicationProvenance{
+					Tool:           provenanceTool,
+					OriginLabels:   map[string]string{},
+					InjectedLabels: map[string]string{"test-labelname": "test-labelvalue"},
+				}, meta.Replication)
+			},
+		},
+		{
+			name: "Relabel",
+			opts: replicationOptions{relabelConfigs: []*relabel.Config{{
+				SourceLabels: []model.LabelName{"test-labelname"},
+				Regex:        relabel.MustNewRegexp("(.*)"),
+				TargetLabel:  "region",
+				Replacement:  "eu",
+				Action:       relabel.Replace,
+			}}},
+			prepare: func(ctx context.Context, t *testing.T, originBucket, targetBucket objstore.Bucket) {
+				ulid := testULID(0)
+				meta := testMeta(ulid)
+
+				b, err := json.Marshal(meta)
+				testutil.Ok(t, err)
+				_ = originBucket.Upload(ctx, path.Join(ulid.String(), "meta.json"), bytes.NewReader(b))
+				_ = originBucket.Upload(ctx, path.Join(ulid.String(), "chunks", "000001"), bytes.NewReader(nil))
+				_ = originBucket.Upload(ctx, path.Join(ulid.String(), "index"), bytes.NewReader(nil))
+			},
+			assert: func(ctx context.Context, t *testing.T, originBucket, targetBucket *inmem.Bucket) {
+				if len(targetBucket.Objects()) != 3 {
+					t.Fatal("TargetBucket should have one block made up of three objects replicated.")
+				}
+
+				var meta replicatedMeta
+				testutil.Ok(t, json.Unmarshal(targetBucket.Objects()[path.Join(testULID(0).String(), "meta.json")], &meta))
+				testutil.Equals(t, map[string]string{"test-labelname": "test-labelvalue", "region": "eu"}, meta.Thanos.Labels)
+				meta.Replication.Time = time.Time{}
+				testutil.Equals(t, &replicationProvenance{Tool: provenanceTool, OriginLabels: map[string]string{"test-labelname": "test-labelvalue"}}, meta.Replication)
+			},
+		},
+		{
+			name: "RelabelDropAll",
+			opts: replicationOptions{relabelConfigs: []*relabel.Config{{
+				SourceLabels: []model.LabelName{"test-labelname"},
+				Regex:        relabel.MustNewRegexp("test-labelvalue"),
+				Action:       relabel.Drop,
+			}}},
+			prepare: func(ctx context.Context, t *testing.T, originBucket, targetBucket objstore.Bucket) {
+				ulid := testULID(0)
+				meta := testMeta(ulid)
+
+				b, err := json.Marshal(meta)
+				testutil.Ok(t, err)
+				_ = originBucket.Upload(ctx, path.Join(ulid.String(), "meta.json"), bytes.NewReader(b))
+				_ = originBucket.Upload(ctx, path.Join(ulid.String(), "chunks", "000001"), bytes.NewReader(nil))
+				_ = originBucket.Upload(ctx, path.Join(ulid.String(), "index"), bytes.NewReader(nil))
+			},
+			assert: func(ctx context.Context, t *testing.T, originBucket, targetBucket *inmem.Bucket) {
+				if len(targetBucket.Objects()) != 0 {
+					t.Fatal("TargetBucket should have been empty but is not.")
+				}
+			},
+		},
+		{
+			name: "TimeRangeOverlap",
+			timeRange: timeRange{
+				minTime: testTime(t, "1970-01-01T00:00:10Z"),
+				maxTime: testTime(t, "1970-01-01T00:00:20Z"),
+				mode:    timeRangeOverlap,
+			},
+			prepare: func(ctx context.Context, t *testing.T, originBucket, targetBucket objstore.Bucket) {
+				for i, r := range [][2]int64{{0, 5000}, {5000, 15000}, {15000, 25000}, {25000, 30000}} {
+					ulid := testULID(int64(i))
+					meta := testMeta(ulid)
+					meta.BlockMeta.MinTime = r[0]
+					meta.BlockMeta.MaxTime = r[1]
+
+					b, err := json.Marshal(meta)
+					testutil.Ok(t, err)
+					_ = originBucket.Upload(ctx, path.Join(ulid.String(), "meta.json"), bytes.NewReader(b))
+					_ = originBucket.Upload(ctx, path.Join(ulid.String(), "index"), bytes.NewReader(nil))
+				}
+			},
+			assert: func(ctx context.Context, t *testing.T, originBucket, targetBucket *inmem.Bucket) {
+				objects := targetBucket.Objects()
+				testutil.Equals(t, 4, len(objects))
+				testutil.Assert(t, objects[path.Join(testULID(1).String(), "meta.json")] != nil, "block overlapping start of time range should have been replicated")
+				testutil.Assert(t, objects[path.Join(testULID(2).String(), "meta.json")] != nil, "block overlapping end of time range should have been replicated")
+			},
+		},
+		{
+			name: "TimeRangeContain",
+			timeRange: timeRange{
+				minTime: testTime(t, "1970-01-01T00:00:10Z"),
+				maxTime: testTime(t, "1970-01-01T00:00:30Z"),
+				mode:    timeRangeContain,
+			},
+			prepare: func(ctx context.Context, t *testing.T, originBucket, targetBucket objstore.Bucket) {
+				for i, r := range [][2]int64{{5000, 15000}, {15000, 25000}, {25000, 35000}} {
+					ulid := testULID(int64(i))
+					meta := testMeta(ulid)
+					meta.BlockMeta.MinTime = r[0]
+					meta.BlockMeta.MaxTime = r[1]
+
+					b, err := json.Marshal(meta)
+					testutil.Ok(t, err)
+					_ = originBucket.Upload(ctx, path.Join(ulid.String(), "meta.json"), bytes.NewReader(b))
+					_ = originBucket.Upload(ctx, path.Join(ulid.String(), "index"), bytes.NewReader(nil))
+				}
+			},
+			assert: func(ctx context.Context, t *testing.T, originBucket, targetBucket *inmem.Bucket) {
+				objects := targetBucket.Objects()
+				testutil.Equals(t, 2, len(objects))
+				testutil.Assert(t, objects[path.Join(testULID(1).String(), "meta.json")] != nil, "block contained in time range should have been replicated")
+			},
+		},
 		{
 			name:     "Regression",
 			selector: labels.Selector{},
@@ -306,14 +716,26 @@ func TestReplicationSchemeAll(t *testing.T) {
 			selector = c.selector
 		}
 
-		filter := NewBlockFilter(logger, selector, compact.ResolutionLevelRaw, 1).Filter
+		resolutions := levelSet{{min: int64(compact.ResolutionLevelRaw), max: int64(compact.ResolutionLevelRaw)}}
+		if c.resolutions != nil {
+			resolutions = c.resolutions
+		}
+
+		compactions := levelSet{{min: 1, max: 1}}
+		if c.compactions != nil {
+			compactions = c.compactions
+		}
+
+		metrics := newReplicationMetrics(nil)
+		filter := NewBlockFilter(logger, metrics.blocksFiltered, selector, resolutions, compactions, c.timeRange, c.sources).FilterReason
 
 		r := newReplicationScheme(
 			logger,
-			newReplicationMetrics(nil),
+			metrics,
 			filter,
-			originBucket,
-			targetBucket,
+			c.opts,
+			[]*replicationOrigin{{name: defaultBucketName, bkt: originBucket}},
+			[]*replicationTarget{{name: defaultBucketName, bkt: targetBucket}},
 		)
 
 		err := r.execute(ctx)
@@ -322,3 +744,548 @@ func TestReplicationSchemeAll(t *testing.T) {
 		c.assert(ctx, t, originBucket, targetBucket)
 	}
 }
+
+// countingBucket counts the objects read from a bucket.
+type countingBucket struct {
+	objstore.Bucket
+
+	mtx  sync.Mutex
+	gets map[string]int
+}
+
+func (b *countingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.mtx.Lock()
+	b.gets[name]++
+	b.mtx.Unlock()
+
+	return b.Bucket.Get(ctx, name)
+}
+
+// bufferedUploadBucket reads uploaded objects fully before uploading them.
+// The in-memory bucket holds its lock while reading an upload, which would
+// serialize the concurrent uploads of a fan-out.
+type bufferedUploadBucket struct {
+	*inmem.Bucket
+}
+
+func (b bufferedUploadBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	return b.Bucket.Upload(ctx, name, bytes.NewReader(content))
+}
+
+// failingUploadBucket is a bucket whose uploads always fail.
+type failingUploadBucket struct {
+	objstore.Bucket
+}
+
+func (b failingUploadBucket) Upload(context.Context, string, io.Reader) error {
+	return errors.New("upload failed")
+}
+
+// metaOrderBucket records the order meta files are uploaded in. Uploads of
+// the other objects of a block are delayed by the delay of the block.
+type metaOrderBucket struct {
+	objstore.Bucket
+
+	delays map[string]time.Duration
+
+	mtx   sync.Mutex
+	metas []string
+}
+
+func (b *metaOrderBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	dir, file := path.Split(name)
+	if file != "meta.json" {
+		time.Sleep(b.delays[strings.SplitN(dir, "/", 2)[0]])
+		return b.Bucket.Upload(ctx, name, r)
+	}
+
+	if err := b.Bucket.Upload(ctx, name, r); err != nil {
+		return err
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.metas = append(b.metas, path.Dir(name))
+
+	return nil
+}
+
+func TestReplicationSchemeConcurrentMetaOrder(t *testing.T) {
+	ctx := context.Background()
+	logger := testLogger(t.Name())
+	originBucket := inmem.NewBucket()
+	targetBucket := &metaOrderBucket{Bucket: inmem.NewBucket(), delays: map[string]time.Duration{}}
+
+	// Two groups of blocks, whose older blocks are the slowest to upload.
+	groups := map[string][]string{}
+
+	for i := int64(0); i < 10; i++ {
+		id := testULID(i)
+		meta := testMeta(id)
+		meta.Thanos.Labels["group"] = fmt.Sprint(i % 2)
+
+		b, err := json.Marshal(meta)
+		testutil.Ok(t, err)
+		testutil.Ok(t, originBucket.Upload(ctx, path.Join(id.String(), "meta.json"), bytes.NewReader(b)))
+		testutil.Ok(t, originBucket.Upload(ctx, path.Join(id.String(), "chunks", "000001"), bytes.NewReader(nil)))
+		testutil.Ok(t, originBucket.Upload(ctx, path.Join(id.String(), "index"), bytes.NewReader(nil)))
+
+		targetBucket.delays[id.String()] = time.Duration(10-i) * 5 * time.Millisecond
+		groups[meta.Thanos.Labels["group"]] = append(groups[meta.Thanos.Labels["group"]], id.String())
+	}
+
+	metrics := newReplicationMetrics(nil)
+	filter := testBlockFilter(logger, metrics.blocksFiltered)
+
+	err := newReplicationScheme(logger, metrics, filter, replicationOptions{blockConcurrency: 4, objectConcurrency: 2}, []*replicationOrigin{{name: defaultBucketName, bkt: originBucket}}, []*replicationTarget{{name: defaultBucketName, bkt: targetBucket}}).execute(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, originBucket.Objects(), targetBucket.Bucket.(*inmem.Bucket).Objects())
+
+	// Meta files of every group are uploaded oldest block first.
+	for group, ids := range groups {
+		var uploaded []string
+
+		for _, id := range targetBucket.metas {
+			for _, groupID := range ids {
+				if id == groupID {
+					uploaded = append(uploaded, id)
+				}
+			}
+		}
+
+		testutil.Equals(t, ids, uploaded, "upload order of group %v", group)
+	}
+}
+
+// blockingMetaBucket blocks the upload of a meta file until released.
+type blockingMetaBucket struct {
+	objstore.Bucket
+
+	metaFile string
+	release  chan struct{}
+}
+
+func (b blockingMetaBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if name == b.metaFile {
+		<-b.release
+	}
+
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func TestReplicationSchemeSlowTargetMetaOrder(t *testing.T) {
+	ctx := context.Background()
+	logger := testLogger(t.Name())
+	originBucket := inmem.NewBucket()
+
+	for i := int64(0); i < 2; i++ {
+		b, err := json.Marshal(testMeta(testULID(i)))
+		testutil.Ok(t, err)
+		testutil.Ok(t, originBucket.Upload(ctx, path.Join(testULID(i).String(), "meta.json"), bytes.NewReader(b)))
+		testutil.Ok(t, originBucket.Upload(ctx, path.Join(testULID(i).String(), "chunks", "000001"), bytes.NewReader(nil)))
+		testutil.Ok(t, originBucket.Upload(ctx, path.Join(testULID(i).String(), "index"), bytes.NewReader(nil)))
+	}
+
+	fast, slow := inmem.NewBucket(), inmem.NewBucket()
+	release := make(chan struct{})
+	targets := []*replicationTarget{
+		{name: "slow", bkt: blockingMetaBucket{Bucket: slow, metaFile: path.Join(testULID(0).String(), "meta.json"), release: release}},
+		{name: "fast", bkt: fast},
+	}
+
+	metrics := newReplicationMetrics(nil)
+	filter := testBlockFilter(logger, metrics.blocksFiltered)
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- newReplicationScheme(logger, metrics, filter, replicationOptions{blockConcurrency: 2}, []*replicationOrigin{{name: defaultBucketName, bkt: originBucket}}, targets).execute(ctx)
+	}()
+
+	// The newer block is replicated to the fast target while the slow target
+	// still uploads the meta file of the older block.
+	newerMeta := path.Join(testULID(1).String(), "meta.json")
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		ok, err := fast.Exists(ctx, newerMeta)
+		testutil.Ok(t, err)
+
+		if ok {
+			break
+		}
+
+		testutil.Assert(t, time.Since(start) < 10*time.Second, "newer block not replicated to the fast target while the slow target is blocked")
+	}
+
+	ok, err := slow.Exists(ctx, newerMeta)
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "newer block replicated to the slow target before the older one")
+
+	close(release)
+	testutil.Ok(t, <-errc)
+	testutil.Equals(t, originBucket.Objects(), fast.Objects())
+	testutil.Equals(t, originBucket.Objects(), slow.Objects())
+}
+
+func TestReplicationSchemeFanOut(t *testing.T) {
+	ctx := context.Background()
+	logger := testLogger(t.Name())
+	originBucket := &countingBucket{Bucket: inmem.NewBucket(), gets: map[string]int{}}
+
+	for _, id := range []ulid.ULID{testULID(0), testULID(1)} {
+		b, err := json.Marshal(testMeta(id))
+		testutil.Ok(t, err)
+		testutil.Ok(t, originBucket.Upload(ctx, path.Join(id.String(), "meta.json"), bytes.NewReader(b)))
+		testutil.Ok(t, originBucket.Upload(ctx, path.Join(id.String(), "chunks", "000001"), bytes.NewReader([]byte("chunks"))))
+		testutil.Ok(t, originBucket.Upload(ctx, path.Join(id.String(), "index"), bytes.NewReader([]byte("index"))))
+	}
+
+	first, second := inmem.NewBucket(), inmem.NewBucket()
+	targets := []*replicationTarget{
+		{name: "first", bkt: bufferedUploadBucket{Bucket: first}},
+		{name: "failing", bkt: failingUploadBucket{Bucket: inmem.NewBucket()}},
+		{name: "second", bkt: bufferedUploadBucket{Bucket: second}},
+	}
+
+	metrics := newReplicationMetrics(nil)
+	filter := testBlockFilter(logger, metrics.blocksFiltered)
+
+	err := newReplicationScheme(logger, metrics, filter, replicationOptions{blockConcurrency: 2, objectConcurrency: 2}, []*replicationOrigin{{name: defaultBucketName, bkt: originBucket}}, targets).execute(ctx)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), "replicate to target failing"), "unexpected error %v", err)
+
+	for _, target := range []*inmem.Bucket{first, second} {
+		testutil.Equals(t, originBucket.Bucket.(*inmem.Bucket).Objects(), target.Objects())
+	}
+
+	// Every object is read once from the origin bucket, meta files once more
+	// while scanning the origin bucket.
+	for name, gets := range originBucket.gets {
+		expected := 1
+		if path.Base(name) == "meta.json" {
+			expected = 2
+		}
+
+		testutil.Equals(t, expected, gets, "number of reads of %v", name)
+	}
+
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(metrics.blocksReplicated.WithLabelValues("0", defaultBucketName, "first")))
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(metrics.blocksReplicated.WithLabelValues("0", defaultBucketName, "second")))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.blocksReplicated.WithLabelValues("0", defaultBucketName, "failing")))
+	testutil.Assert(t, promtestutil.ToFloat64(metrics.targetBlockFailures.WithLabelValues(defaultBucketName, "failing")) > 0, "failures of the failing target should be counted")
+
+	// Objects other than meta files are read once and written to every
+	// target, meta files are only written.
+	var objectBytes, metaBytes int
+	for name, content := range first.Objects() {
+		if path.Base(name) == "meta.json" {
+			metaBytes += len(content)
+		} else {
+			objectBytes += len(content)
+		}
+	}
+
+	testutil.Equals(t, float64(objectBytes), promtestutil.ToFloat64(metrics.originBytesRead.WithLabelValues(defaultBucketName)))
+	testutil.Equals(t, float64(objectBytes+metaBytes), promtestutil.ToFloat64(metrics.targetBytesWritten.WithLabelValues("first")))
+	testutil.Equals(t, float64(objectBytes+metaBytes), promtestutil.ToFloat64(metrics.targetBytesWritten.WithLabelValues("second")))
+
+	testutil.Equals(t, uint64(4), histogramCount(t, metrics.objectSize, defaultBucketName))
+	testutil.Equals(t, uint64(4), histogramCount(t, metrics.objectDuration, defaultBucketName))
+	testutil.Equals(t, uint64(2), histogramCount(t, metrics.blockSize, defaultBucketName))
+	testutil.Equals(t, uint64(2), histogramCount(t, metrics.blockDuration, defaultBucketName))
+	testutil.Equals(t, float64(objectBytes), histogramSum(t, metrics.objectSize, defaultBucketName))
+	testutil.Equals(t, float64(objectBytes+metaBytes), histogramSum(t, metrics.blockSize, defaultBucketName))
+}
+
+func histogramCount(t *testing.T, h *prometheus.HistogramVec, origin string) uint64 {
+	m := &dto.Metric{}
+	testutil.Ok(t, h.WithLabelValues(origin).(prometheus.Histogram).Write(m))
+
+	return m.GetHistogram().GetSampleCount()
+}
+
+func histogramSum(t *testing.T, h *prometheus.HistogramVec, origin string) float64 {
+	m := &dto.Metric{}
+	testutil.Ok(t, h.WithLabelValues(origin).(prometheus.Histogram).Write(m))
+
+	return m.GetHistogram().GetSampleSum()
+}
+
+func TestReplicationSchemeVerificationMetrics(t *testing.T) {
+	ctx := context.Background()
+	logger := testLogger(t.Name())
+	originBucket, targetBucket := inmem.NewBucket(), inmem.NewBucket()
+
+	meta := testMeta(testULID(0))
+	b, err := json.Marshal(meta)
+	testutil.Ok(t, err)
+	testutil.Ok(t, originBucket.Upload(ctx, path.Join(meta.ULID.String(), "meta.json"), bytes.NewReader(b)))
+
+	// Objects already present in the target are verified, not copied.
+	for _, bkt := range []*inmem.Bucket{originBucket, targetBucket} {
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(meta.ULID.String(), "chunks", "000001"), bytes.NewReader([]byte("chunks"))))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(meta.ULID.String(), "index"), bytes.NewReader([]byte("index"))))
+	}
+
+	metrics := newReplicationMetrics(nil)
+	rs := newReplicationScheme(logger, metrics, testBlockFilter(logger, metrics.blocksFiltered), replicationOptions{objectVerification: objectVerificationSize}, nil, nil)
+	origin := &replicationOrigin{name: defaultBucketName, bkt: originBucket}
+	targets := []*replicationTarget{{name: defaultBucketName, bkt: targetBucket}}
+
+	// Waiting for older blocks is not part of the replication duration.
+	wait := 500 * time.Millisecond
+	errs := rs.ensureBlockIsReplicated(ctx, origin, meta, targets, func(context.Context, *replicationTarget) error {
+		time.Sleep(wait)
+		return nil
+	}, func(*replicationTarget, error) {})
+	testutil.Equals(t, map[string]error{defaultBucketName: nil}, errs)
+
+	// Verified objects are read in full from the origin.
+	testutil.Equals(t, float64(len("chunks")+len("index")), promtestutil.ToFloat64(metrics.originBytesRead.WithLabelValues(defaultBucketName)))
+	testutil.Equals(t, uint64(1), histogramCount(t, metrics.blockDuration, defaultBucketName))
+	testutil.Assert(t, histogramSum(t, metrics.blockDuration, defaultBucketName) < wait.Seconds(), "replication duration includes waiting for older blocks: %v", histogramSum(t, metrics.blockDuration, defaultBucketName))
+}
+
+func TestReplicationSchemeCompactedInTargetMetrics(t *testing.T) {
+	ctx := context.Background()
+	logger := testLogger(t.Name())
+	originBucket, compactedBucket, emptyBucket := inmem.NewBucket(), inmem.NewBucket(), inmem.NewBucket()
+
+	source := testULID(0)
+	b, err := json.Marshal(testMeta(source))
+	testutil.Ok(t, err)
+	testutil.Ok(t, originBucket.Upload(ctx, path.Join(source.String(), "meta.json"), bytes.NewReader(b)))
+	testutil.Ok(t, originBucket.Upload(ctx, path.Join(source.String(), "chunks", "000001"), bytes.NewReader(nil)))
+	testutil.Ok(t, originBucket.Upload(ctx, path.Join(source.String(), "index"), bytes.NewReader(nil)))
+
+	// Only one target holds a block compacted from the origin block.
+	meta := testMeta(testULID(1))
+	meta.BlockMeta.Compaction.Level = 2
+	meta.BlockMeta.Compaction.Sources = []ulid.ULID{source, testULID(2)}
+
+	b, err = json.Marshal(meta)
+	testutil.Ok(t, err)
+	testutil.Ok(t, compactedBucket.Upload(ctx, path.Join(testULID(1).String(), "meta.json"), bytes.NewReader(b)))
+
+	metrics := newReplicationMetrics(nil)
+	targets := []*replicationTarget{
+		{name: "compacted", bkt: compactedBucket},
+		{name: "empty", bkt: emptyBucket},
+	}
+
+	err = newReplicationScheme(logger, metrics, testBlockFilter(logger, metrics.blocksFiltered), replicationOptions{skipCompactedInTarget: true}, []*replicationOrigin{{name: defaultBucketName, bkt: originBucket}}, targets).execute(ctx)
+	testutil.Ok(t, err)
+
+	testutil.Equals(t, originBucket.Objects(), emptyBucket.Objects())
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.blocksCompactedInTarget.WithLabelValues("compacted")))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.blocksCompactedInTarget.WithLabelValues("empty")))
+}
+
+func TestReplicationSchemeRelabelDropMetrics(t *testing.T) {
+	ctx := context.Background()
+	logger := testLogger(t.Name())
+	originBucket, targetBucket := inmem.NewBucket(), inmem.NewBucket()
+
+	b, err := json.Marshal(testMeta(testULID(0)))
+	testutil.Ok(t, err)
+	testutil.Ok(t, originBucket.Upload(ctx, path.Join(testULID(0).String(), "meta.json"), bytes.NewReader(b)))
+
+	metrics := newReplicationMetrics(nil)
+	opts := replicationOptions{relabelConfigs: []*relabel.Config{{
+		SourceLabels: []model.LabelName{"test-labelname"},
+		Regex:        relabel.MustNewRegexp("test-labelvalue"),
+		Action:       relabel.Drop,
+	}}}
+
+	err = newReplicationScheme(logger, metrics, testBlockFilter(logger, metrics.blocksFiltered), opts, []*replicationOrigin{{name: defaultBucketName, bkt: originBucket}}, []*replicationTarget{{name: defaultBucketName, bkt: targetBucket}}).execute(ctx)
+	testutil.Ok(t, err)
+
+	// Blocks dropped by the relabel config are counted with the filtered
+	// blocks.
+	testutil.Equals(t, 0, len(targetBucket.Objects()))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.blocksFiltered.WithLabelValues(filterReasonDroppedByRelabel)))
+}
+
+func TestReplicationSchemeFanIn(t *testing.T) {
+	ctx := context.Background()
+	logger := testLogger(t.Name())
+	first, second := inmem.NewBucket(), inmem.NewBucket()
+
+	upload := func(bkt objstore.Bucket, meta *metadata.Meta) {
+		b, err := json.Marshal(meta)
+		testutil.Ok(t, err)
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(meta.ULID.String(), "meta.json"), bytes.NewReader(b)))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(meta.ULID.String(), "chunks", "000001"), bytes.NewReader(nil)))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(meta.ULID.String(), "index"), bytes.NewReader(nil)))
+	}
+
+	// The same block in both origins.
+	upload(first, testMeta(testULID(0)))
+	upload(second, testMeta(testULID(0)))
+
+	// A block only present in the second origin.
+	upload(second, testMeta(testULID(1)))
+
+	// Different blocks with the same ID.
+	upload(first, testMeta(testULID(2)))
+
+	collision := testMeta(testULID(2))
+	collision.Thanos.Labels["other"] = "value"
+	upload(second, collision)
+
+	targetBucket := inmem.NewBucket()
+	metrics := newReplicationMetrics(nil)
+	filter := testBlockFilter(logger, metrics.blocksFiltered)
+
+	origins := []*replicationOrigin{
+		{name: "first", bkt: first},
+		{name: "second", bkt: second},
+	}
+
+	err := newReplicationScheme(logger, metrics, filter, replicationOptions{}, origins, []*replicationTarget{{name: defaultBucketName, bkt: targetBucket}}).execute(ctx)
+	testutil.Ok(t, err)
+
+	objects := targetBucket.Objects()
+	testutil.Equals(t, 6, len(objects))
+	testutil.Equals(t, first.Objects()[path.Join(testULID(0).String(), "meta.json")], objects[path.Join(testULID(0).String(), "meta.json")])
+	testutil.Equals(t, second.Objects()[path.Join(testULID(1).String(), "meta.json")], objects[path.Join(testULID(1).String(), "meta.json")])
+
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.originBlockCollisions.WithLabelValues("first")))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.originBlockCollisions.WithLabelValues("second")))
+}
+
+func TestReplicationSchemePrefix(t *testing.T) {
+	ctx := context.Background()
+	logger := testLogger(t.Name())
+	originBucket, targetBucket := inmem.NewBucket(), inmem.NewBucket()
+
+	meta := testMeta(testULID(0))
+	b, err := json.Marshal(meta)
+	testutil.Ok(t, err)
+	testutil.Ok(t, originBucket.Upload(ctx, path.Join("a", meta.ULID.String(), "meta.json"), bytes.NewReader(b)))
+	testutil.Ok(t, originBucket.Upload(ctx, path.Join("a", meta.ULID.String(), "chunks", "000001"), bytes.NewReader(nil)))
+	testutil.Ok(t, originBucket.Upload(ctx, path.Join("a", meta.ULID.String(), "index"), bytes.NewReader(nil)))
+
+	// Objects outside of the prefixes are left alone.
+	testutil.Ok(t, originBucket.Upload(ctx, path.Join(testULID(1).String(), "meta.json"), bytes.NewReader(b)))
+	testutil.Ok(t, targetBucket.Upload(ctx, path.Join("c", "object"), bytes.NewReader(nil)))
+
+	metrics := newReplicationMetrics(nil)
+	filter := testBlockFilter(logger, metrics.blocksFiltered)
+
+	origins := []*replicationOrigin{{name: defaultBucketName, bkt: newPrefixedBucket(originBucket, "a/")}}
+	targets := []*replicationTarget{{name: defaultBucketName, bkt: newPrefixedBucket(targetBucket, "/b")}}
+
+	err = newReplicationScheme(logger, metrics, filter, replicationOptions{}, origins, targets).execute(ctx)
+	testutil.Ok(t, err)
+
+	objects := targetBucket.Objects()
+	testutil.Equals(t, 4, len(objects))
+	testutil.Equals(t, b, objects[path.Join("b", meta.ULID.String(), "meta.json")])
+	_, ok := objects[path.Join("b", meta.ULID.String(), "chunks", "000001")]
+	testutil.Assert(t, ok, "chunks not replicated under the target prefix")
+	_, ok = objects[path.Join("b", meta.ULID.String(), "index")]
+	testutil.Assert(t, ok, "index not replicated under the target prefix")
+	_, ok = objects[path.Join("c", "object")]
+	testutil.Assert(t, ok, "object outside of the target prefix removed")
+}
+
+func TestReplicationSchemeDryRun(t *testing.T) {
+	ctx := context.Background()
+	logger := testLogger(t.Name())
+	originBucket, targetBucket := inmem.NewBucket(), inmem.NewBucket()
+
+	upload := func(meta *metadata.Meta) {
+		b, err := json.Marshal(meta)
+		testutil.Ok(t, err)
+		testutil.Ok(t, originBucket.Upload(ctx, path.Join(meta.ULID.String(), "meta.json"), bytes.NewReader(b)))
+		testutil.Ok(t, originBucket.Upload(ctx, path.Join(meta.ULID.String(), "chunks", "000001"), bytes.NewReader([]byte("chunks"))))
+		testutil.Ok(t, originBucket.Upload(ctx, path.Join(meta.ULID.String(), "index"), bytes.NewReader([]byte("index"))))
+	}
+
+	metrics := newReplicationMetrics(nil)
+	filter := testBlockFilter(logger, metrics.blocksFiltered)
+
+	origins := []*replicationOrigin{{name: defaultBucketName, bkt: originBucket}}
+	targets := []*replicationTarget{{name: defaultBucketName, bkt: targetBucket}}
+
+	// An already replicated block.
+	upload(testMeta(testULID(0)))
+	testutil.Ok(t, newReplicationScheme(logger, metrics, filter, replicationOptions{}, origins, targets).execute(ctx))
+
+	// A block to replicate.
+	upload(testMeta(testULID(1)))
+
+	// A block not selected by the block filters.
+	filtered := testMeta(testULID(2))
+	filtered.Thanos.Labels = map[string]string{"other": "value"}
+	upload(filtered)
+
+	before := targetBucket.Objects()
+	metaFile := path.Join(testULID(1).String(), "meta.json")
+	metaSize := int64(len(originBucket.Objects()[metaFile]))
+
+	skipped := []skippedBlock{
+		{ULID: testULID(2), Origin: defaultBucketName, Reason: "filtered-" + filterReasonLabels},
+		{ULID: testULID(0), Origin: defaultBucketName, Target: defaultBucketName, Reason: skipReasonAlreadyReplicated},
+	}
+
+	// By default, missing objects are not read from the origin bucket.
+	counting := &countingBucket{Bucket: originBucket, gets: map[string]int{}}
+	rs := newReplicationScheme(logger, metrics, filter, replicationOptions{dryRun: true}, []*replicationOrigin{{name: defaultBucketName, bkt: counting}}, targets)
+	testutil.Ok(t, rs.execute(ctx))
+	testutil.Equals(t, before, targetBucket.Objects())
+
+	for name := range counting.gets {
+		testutil.Equals(t, "meta.json", path.Base(name), "unexpected read of %v", name)
+	}
+
+	testutil.Equals(t, 1, len(rs.plan.Blocks))
+	testutil.Equals(t, []plannedObject{
+		{Name: path.Join(testULID(1).String(), "chunks", "000001")},
+		{Name: path.Join(testULID(1).String(), "index")},
+		{Name: metaFile},
+	}, rs.plan.Blocks[0].MissingObjects)
+	testutil.Equals(t, 3, rs.plan.TotalObjects)
+	testutil.Equals(t, int64(0), rs.plan.TotalBytes)
+	testutil.Equals(t, skipped, rs.plan.Skipped)
+
+	var buf bytes.Buffer
+	testutil.Ok(t, rs.plan.write(&buf, outputFormatTable))
+	testutil.Assert(t, strings.Contains(buf.String(), "1 blocks to replicate, 3 objects in total, 2 blocks skipped."), "unexpected table output:\n%s", buf.String())
+	testutil.Assert(t, !strings.Contains(buf.String(), "BYTES"), "unexpected table output:\n%s", buf.String())
+
+	// Sizes are reported on request.
+	rs = newReplicationScheme(logger, metrics, filter, replicationOptions{dryRun: true, dryRunSizes: true}, origins, targets)
+	testutil.Ok(t, rs.execute(ctx))
+	testutil.Equals(t, before, targetBucket.Objects())
+
+	testutil.Equals(t, 1, len(rs.plan.Blocks))
+	testutil.Equals(t, testULID(1), rs.plan.Blocks[0].ULID)
+	testutil.Equals(t, []plannedObject{
+		{Name: path.Join(testULID(1).String(), "chunks", "000001"), Size: 6},
+		{Name: path.Join(testULID(1).String(), "index"), Size: 5},
+		{Name: metaFile, Size: metaSize},
+	}, rs.plan.Blocks[0].MissingObjects)
+	testutil.Equals(t, 3, rs.plan.TotalObjects)
+	testutil.Equals(t, 11+metaSize, rs.plan.TotalBytes)
+	testutil.Equals(t, skipped, rs.plan.Skipped)
+
+	buf.Reset()
+	testutil.Ok(t, rs.plan.write(&buf, outputFormatJSON))
+
+	var decoded replicationPlan
+	testutil.Ok(t, json.Unmarshal(buf.Bytes(), &decoded))
+	testutil.Equals(t, rs.plan.Skipped, decoded.Skipped)
+	testutil.Equals(t, rs.plan.TotalBytes, decoded.TotalBytes)
+	testutil.Assert(t, decoded.Sizes, "sizes not reported in the JSON output")
+
+	buf.Reset()
+	testutil.Ok(t, rs.plan.write(&buf, outputFormatTable))
+	testutil.Assert(t, strings.Contains(buf.String(), fmt.Sprintf("1 blocks to replicate, 3 objects, %d bytes in total, 2 blocks skipped.", 11+metaSize)), "unexpected table output:\n%s", buf.String())
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	promlabels "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb/labels"
+)
+
+// promMatcher adapts a PromQL style matcher to the labels.Matcher interface
+// used for block selection.
+type promMatcher struct {
+	m *promlabels.Matcher
+}
+
+func (p promMatcher) Name() string          { return p.m.Name }
+func (p promMatcher) Matches(v string) bool { return p.m.Matches(v) }
+func (p promMatcher) String() string        { return p.m.String() }
+
+// selectorString renders the selector the same way it is written in PromQL.
+func selectorString(sel labels.Selector) string {
+	matchers := make([]string, 0, len(sel))
+	for _, m := range sel {
+		matchers = append(matchers, m.String())
+	}
+
+	return "{" + strings.Join(matchers, ",") + "}"
+}
+
+// parseSelector parses a PromQL series selector without metric name, like
+// {cluster=~"prod-.*",env!="dev"}. The surrounding braces are optional, so a
+// single matcher like cluster="prod" is accepted as well.
+func parseSelector(s string) ([]labels.Matcher, error) {
+	p := &selectorParser{input: s}
+	return p.parse()
+}
+
+type selectorParser struct {
+	input string
+	pos   int
+}
+
+func (p *selectorParser) parse() ([]labels.Matcher, error) {
+	matchers := []labels.Matcher{}
+
+	p.skipSpaces()
+
+	braced := p.consume("{")
+
+	for {
+		p.skipSpaces()
+
+		if braced && p.consume("}") {
+			break
+		}
+
+		if !braced && p.eof() {
+			break
+		}
+
+		m, err := p.parseMatcher()
+		if err != nil {
+			return nil, err
+		}
+
+		matchers = append(matchers, m)
+
+		p.skipSpaces()
+
+		if p.consume(",") {
+			continue
+		}
+
+		if braced && p.peek("}") {
+			continue
+		}
+
+		if !braced && p.eof() {
+			break
+		}
+
+		if braced {
+			return nil, p.errorf("expected \",\" or \"}\"")
+		}
+
+		return nil, p.errorf("expected \",\" or end of selector")
+	}
+
+	p.skipSpaces()
+
+	if !p.eof() {
+		return nil, p.errorf("unexpected input after end of selector")
+	}
+
+	return matchers, nil
+}
+
+func (p *selectorParser) parseMatcher() (labels.Matcher, error) {
+	start := p.pos
+	for !p.eof() && isLabelNameChar(p.input[p.pos], p.pos == start) {
+		p.pos++
+	}
+
+	name := p.input[start:p.pos]
+	if name == "" {
+		return nil, p.errorf("expected label name")
+	}
+
+	p.skipSpaces()
+
+	var t promlabels.MatchType
+
+	switch {
+	case p.consume("=~"):
+		t = promlabels.MatchRegexp
+	case p.consume("!~"):
+		t = promlabels.MatchNotRegexp
+	case p.consume("!="):
+		t = promlabels.MatchNotEqual
+	case p.consume("="):
+		t = promlabels.MatchEqual
+	default:
+		return nil, p.errorf("expected one of \"=\", \"!=\", \"=~\", \"!~\" after label name %q", name)
+	}
+
+	p.skipSpaces()
+
+	valueStart := p.pos
+
+	value, err := p.parseString()
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := promlabels.NewMatcher(t, name, value)
+	if err != nil {
+		p.pos = valueStart
+		return nil, p.errorf("invalid regular expression %q: %v", value, err)
+	}
+
+	return promMatcher{m: m}, nil
+}
+
+// parseString parses a double quoted or backtick quoted Go string.
+func (p *selectorParser) parseString() (string, error) {
+	if p.eof() || (p.input[p.pos] != '"' && p.input[p.pos] != '`') {
+		return "", p.errorf("expected quoted label value")
+	}
+
+	quote := p.input[p.pos]
+	start := p.pos
+
+	for i := start + 1; i < len(p.input); i++ {
+		switch p.input[i] {
+		case '\\':
+			if quote == '"' {
+				i++
+			}
+		case quote:
+			value, err := strconv.Unquote(p.input[start : i+1])
+			if err != nil {
+				return "", p.errorf("invalid quoted label value: %v", err)
+			}
+
+			p.pos = i + 1
+
+			return value, nil
+		}
+	}
+
+	return "", p.errorf("unterminated quoted label value")
+}
+
+func (p *selectorParser) eof() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *selectorParser) peek(s string) bool {
+	return strings.HasPrefix(p.input[p.pos:], s)
+}
+
+func (p *selectorParser) consume(s string) bool {
+	if !p.peek(s) {
+		return false
+	}
+
+	p.pos += len(s)
+
+	return true
+}
+
+func (p *selectorParser) skipSpaces() {
+	for !p.eof() && (p.input[p.pos] == ' ' || p.input[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// errorf returns an error pointing at the current position of the parser.
+func (p *selectorParser) errorf(format string, args ...interface{}) error {
+	token := p.input[p.pos:]
+	if len(token) > 10 {
+		token = token[:10] + "..."
+	}
+
+	if token == "" {
+		return errors.Errorf(format+" at end of input", args...)
+	}
+
+	return errors.Errorf(format+" at position %d near %q", append(args, p.pos, token)...)
+}
+
+func isLabelNameChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
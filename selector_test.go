@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+)
+
+func TestParseFlagMatchers(t *testing.T) {
+	var cases = []struct {
+		name     string
+		input    []string
+		expected string
+		err      string
+		matches  labels.Labels
+		excludes labels.Labels
+	}{
+		{
+			name:     "Equal",
+			input:    []string{`cluster="prod"`},
+			expected: `{cluster="prod"}`,
+			matches:  labels.FromStrings("cluster", "prod"),
+			excludes: labels.FromStrings("cluster", "prod-2"),
+		},
+		{
+			name:     "AllOperators",
+			input:    []string{`{cluster=~"prod-.*", env!="dev",tenant!~"internal|test"}`},
+			expected: `{cluster=~"prod-.*",env!="dev",tenant!~"internal|test"}`,
+			matches:  labels.FromStrings("cluster", "prod-eu", "env", "prd", "tenant", "team"),
+			excludes: labels.FromStrings("cluster", "prod-eu", "env", "dev", "tenant", "team"),
+		},
+		{
+			name:     "RegexpIsAnchored",
+			input:    []string{`cluster=~"prod"`},
+			expected: `{cluster=~"prod"}`,
+			matches:  labels.FromStrings("cluster", "prod"),
+			excludes: labels.FromStrings("cluster", "preprod"),
+		},
+		{
+			name:     "MultipleFlags",
+			input:    []string{`cluster="prod"`, "{env=`dev`}"},
+			expected: `{cluster="prod",env="dev"}`,
+		},
+		{
+			name:     "Empty",
+			input:    []string{`{}`},
+			expected: `{}`,
+		},
+		{
+			name:  "UnquotedValue",
+			input: []string{`cluster=prod`},
+			err:   `parse matcher "cluster=prod": expected quoted label value at position 8 near "prod"`,
+		},
+		{
+			name:  "InvalidOperator",
+			input: []string{`{cluster=="prod"}`},
+			err:   `parse matcher "{cluster==\"prod\"}": expected quoted label value at position 9 near "=\"prod\"}"`,
+		},
+		{
+			name:  "MissingOperator",
+			input: []string{`cluster`},
+			err:   `parse matcher "cluster": expected one of "=", "!=", "=~", "!~" after label name "cluster" at end of input`,
+		},
+		{
+			name:  "UnclosedSelector",
+			input: []string{`{cluster="prod"`},
+			err:   `parse matcher "{cluster=\"prod\"": expected "," or "}" at end of input`,
+		},
+		{
+			name:  "InvalidRegexp",
+			input: []string{`cluster=~"prod("`},
+			err:   "parse matcher \"cluster=~\\\"prod(\\\"\": invalid regular expression \"prod(\": error parsing regexp: missing closing ): `^(?:prod()$` at position 9 near \"\\\"prod(\\\"\"",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			matchers, err := parseFlagMatchers(c.input)
+			if c.err != "" {
+				testutil.NotOk(t, err)
+				testutil.Equals(t, c.err, err.Error())
+
+				return
+			}
+
+			testutil.Ok(t, err)
+			testutil.Equals(t, c.expected, selectorString(matchers))
+
+			if c.matches != nil {
+				testutil.Assert(t, labels.Selector(matchers).Matches(c.matches), "selector should match %s", c.matches)
+			}
+
+			if c.excludes != nil {
+				testutil.Assert(t, !labels.Selector(matchers).Matches(c.excludes), "selector should not match %s", c.excludes)
+			}
+		})
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/run"
+	"github.com/oklog/ulid"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	thanosblock "github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/extflag"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+func registerVerify(m map[string]setupFunc, app *kingpin.Application, name string) {
+	cmd := app.Command(name, "Downloads blocks of the target bucket and verifies their integrity, exiting with a non-zero code if any block is broken.")
+
+	toObjStoreConfig := regCommonObjStoreFlags(cmd, "to", false)
+	toPrefix := cmd.Flag("to.prefix", "Directory of the target bucket the blocks are stored in, e.g. thanos/dr.").Default("").String()
+
+	filterFlags := regBlockFilterFlags(cmd, "verified")
+
+	sample := cmd.Flag("sample", "Fraction of the selected blocks to verify, picked at random, e.g. 0.1 to verify a tenth of them.").Default("1").Float64()
+	maxBlocks := cmd.Flag("sample.max-blocks", "Maximum number of blocks to verify, picked at random among the selected blocks. 0 means unlimited.").Default("0").Int()
+
+	dataDir := cmd.Flag("data-dir", "Directory blocks are downloaded to while being verified. A temporary directory is used if unset.").Default("").String()
+
+	output := cmd.Flag("output", "Output format of the verification report.").
+		Default(string(outputFormatTable)).Enum(string(outputFormatTable), string(outputFormatJSON))
+
+	m[name] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, _ opentracing.Tracer, _ bool) error {
+		filterConf, err := filterFlags.parse()
+		if err != nil {
+			return err
+		}
+
+		if *sample <= 0 || *sample > 1 {
+			return errors.Errorf("sample must be greater than 0 and at most 1, got %v", *sample)
+		}
+
+		if *maxBlocks < 0 {
+			return errors.Errorf("sample max blocks must not be negative, got %d", *maxBlocks)
+		}
+
+		return runVerify(
+			g,
+			logger,
+			reg,
+			filterConf,
+			toObjStoreConfig,
+			*toPrefix,
+			blockSampler{ratio: *sample, maxBlocks: *maxBlocks, rnd: rand.New(rand.NewSource(time.Now().UnixNano()))},
+			*dataDir,
+			outputFormat(*output),
+		)
+	}
+}
+
+func runVerify(
+	g *run.Group,
+	logger log.Logger,
+	reg *prometheus.Registry,
+	filterConf blockFilterConfig,
+	toObjStoreConfig *extflag.PathOrContent,
+	toPrefix string,
+	sampler blockSampler,
+	dataDir string,
+	output outputFormat,
+) error {
+	logger = log.With(logger, "component", "verify")
+
+	bkt, err := newBucketFromConfig(logger, reg, toObjStoreConfig, toPrefix, "to")
+	if err != nil {
+		return errors.Wrap(err, "create target bucket")
+	}
+
+	// Filtered blocks are not reported as metrics, as the command does not
+	// serve any.
+	blockFilter := filterConf.newBlockFilter(logger, newReplicationMetrics(nil).blocksFiltered).FilterReason
+	ctx, cancel := context.WithCancel(context.Background())
+
+	g.Add(func() error {
+		defer runutil.CloseWithLogOnErr(logger, bkt, "to bucket client")
+
+		dir := dataDir
+		if dir == "" {
+			tmpDir, err := ioutil.TempDir("", "thanos-replicate-verify")
+			if err != nil {
+				return errors.Wrap(err, "create temporary directory")
+			}
+
+			defer func() {
+				if err := os.RemoveAll(tmpDir); err != nil {
+					level.Warn(logger).Log("msg", "failed to remove temporary directory", "dir", tmpDir, "err", err)
+				}
+			}()
+
+			dir = tmpDir
+		}
+
+		r, err := verifyBlocks(ctx, logger, bkt, blockFilter, sampler, dir)
+		if err != nil {
+			return errors.Wrap(err, "verify blocks")
+		}
+
+		if err := r.write(os.Stdout, output); err != nil {
+			return errors.Wrap(err, "write verification report")
+		}
+
+		if r.Failed > 0 {
+			return errors.Errorf("%d of %d verified blocks are broken", r.Failed, r.Verified)
+		}
+
+		level.Info(logger).Log("msg", "all verified blocks are healthy", "verified_blocks", r.Verified)
+
+		return nil
+	}, func(error) {
+		cancel()
+	})
+
+	return nil
+}
+
+// blockSampler picks the blocks to verify among the selected ones.
+type blockSampler struct {
+	// ratio is the fraction of blocks picked, in (0, 1].
+	ratio float64
+	// maxBlocks is the maximum number of blocks picked, 0 means unlimited.
+	maxBlocks int
+
+	rnd *rand.Rand
+}
+
+// sample returns a random subset of the blocks, oldest first.
+func (s blockSampler) sample(ids []ulid.ULID) []ulid.ULID {
+	n := int(math.Ceil(float64(len(ids)) * s.ratio))
+	if s.maxBlocks > 0 && n > s.maxBlocks {
+		n = s.maxBlocks
+	}
+
+	if n >= len(ids) {
+		return ids
+	}
+
+	sampled := make([]ulid.ULID, 0, n)
+	for _, i := range s.rnd.Perm(len(ids))[:n] {
+		sampled = append(sampled, ids[i])
+	}
+
+	sort.Slice(sampled, func(i, j int) bool {
+		return sampled[i].Compare(sampled[j]) < 0
+	})
+
+	return sampled
+}
+
+// verifyReport holds the result of a verification run.
+type verifyReport struct {
+	Blocks []blockVerification `json:"blocks"`
+
+	// Selected is the number of blocks selected by the block filters, of
+	// which Verified were sampled and verified.
+	Selected int `json:"selected"`
+	Verified int `json:"verified"`
+	Failed   int `json:"failed"`
+}
+
+// blockVerification is the result of the verification of a single block.
+type blockVerification struct {
+	ULID    ulid.ULID `json:"ulid"`
+	MinTime int64     `json:"min_time"`
+	MaxTime int64     `json:"max_time"`
+
+	Series int `json:"series"`
+	Chunks int `json:"chunks"`
+
+	IndexStats *thanosblock.Stats `json:"index_stats,omitempty"`
+	// BrokenChunks is the number of chunk references of the index that could
+	// not be read from the chunk segments.
+	BrokenChunks int `json:"broken_chunks"`
+	// OutOfBoundsSamples is the number of samples outside of the time range
+	// of their chunk in the index.
+	OutOfBoundsSamples int `json:"out_of_bounds_samples"`
+
+	Errors []string `json:"errors"`
+}
+
+func (v *blockVerification) fail(format string, args ...interface{}) {
+	v.Errors = append(v.Errors, fmt.Sprintf(format, args...))
+}
+
+// write writes the report in the given format.
+func (r *verifyReport) write(w io.Writer, format outputFormat) error {
+	if format == outputFormatJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(r)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "BLOCK\tMIN TIME\tMAX TIME\tSERIES\tCHUNKS\tRESULT\tERRORS")
+
+	for _, v := range r.Blocks {
+		result := "ok"
+		if len(v.Errors) > 0 {
+			result = "failed"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n",
+			v.ULID,
+			timestamp.Time(v.MinTime).UTC().Format("2006-01-02T15:04:05Z"),
+			timestamp.Time(v.MaxTime).UTC().Format("2006-01-02T15:04:05Z"),
+			v.Series, v.Chunks, result, strings.Join(v.Errors, "; "),
+		)
+	}
+
+	fmt.Fprintln(tw)
+	fmt.Fprintf(tw, "%d blocks selected, %d verified, %d failed.\n", r.Selected, r.Verified, r.Failed)
+
+	return tw.Flush()
+}
+
+// verifyBlocks downloads a sample of the blocks selected by the block filter
+// to dir, one at a time, and verifies them.
+func verifyBlocks(ctx context.Context, logger log.Logger, bkt objstore.Bucket, blockFilter blockFilterFunc, sampler blockSampler, dir string) (*verifyReport, error) {
+	metas, err := loadBlockMetas(ctx, logger, bkt)
+	if err != nil {
+		return nil, errors.Wrap(err, "load blocks")
+	}
+
+	selected := []ulid.ULID{}
+
+	for _, id := range sortedBlockIDs(metas) {
+		if meta := metas[id]; meta != nil && blockFilter(meta) == "" {
+			selected = append(selected, id)
+		}
+	}
+
+	r := &verifyReport{
+		Blocks:   []blockVerification{},
+		Selected: len(selected),
+	}
+
+	for _, id := range sampler.sample(selected) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		level.Info(logger).Log("msg", "verifying block", "block_uuid", id.String())
+
+		v := verifyBlock(ctx, logger, bkt, metas[id], dir)
+		if len(v.Errors) > 0 {
+			level.Warn(logger).Log("msg", "block is broken", "block_uuid", id.String(), "errors", strings.Join(v.Errors, "; "))
+			r.Failed++
+		}
+
+		r.Blocks = append(r.Blocks, v)
+		r.Verified++
+	}
+
+	return r, nil
+}
+
+// verifyBlock downloads a block to dir and checks its time range, its index
+// and that every chunk referenced by the index can be read and is within the
+// time range recorded in the index. The downloaded block is removed
+// afterwards.
+func verifyBlock(ctx context.Context, logger log.Logger, bkt objstore.Bucket, meta *metadata.Meta, dir string) blockVerification {
+	id := meta.BlockMeta.ULID
+	v := blockVerification{
+		ULID:    id,
+		MinTime: meta.BlockMeta.MinTime,
+		MaxTime: meta.BlockMeta.MaxTime,
+		Errors:  []string{},
+	}
+
+	if meta.BlockMeta.MinTime >= meta.BlockMeta.MaxTime {
+		v.fail("invalid time range, min time %d is not before max time %d", meta.BlockMeta.MinTime, meta.BlockMeta.MaxTime)
+	}
+
+	blockDir := filepath.Join(dir, id.String())
+
+	defer func() {
+		if err := os.RemoveAll(blockDir); err != nil {
+			level.Warn(logger).Log("msg", "failed to remove downloaded block", "block_uuid", id.String(), "err", err)
+		}
+	}()
+
+	if err := thanosblock.Download(ctx, logger, bkt, id, blockDir); err != nil {
+		v.fail("download block: %v", err)
+		return v
+	}
+
+	// The stats are checked the same way block.VerifyIndex does, without
+	// reading the index twice.
+	stats, err := thanosblock.GatherIndexIssueStats(logger, filepath.Join(blockDir, thanosblock.IndexFilename), meta.BlockMeta.MinTime, meta.BlockMeta.MaxTime)
+	if err != nil {
+		v.fail("gather index issue stats: %v", err)
+	} else {
+		v.IndexStats = &stats
+
+		if err := stats.AnyErr(); err != nil {
+			v.fail("verify index: %v", err)
+		}
+	}
+
+	if err := verifyChunks(logger, blockDir, &v); err != nil {
+		v.fail("verify chunks: %v", err)
+	}
+
+	if v.BrokenChunks > 0 {
+		v.fail("%d chunk references could not be read", v.BrokenChunks)
+	}
+
+	if v.OutOfBoundsSamples > 0 {
+		v.fail("%d samples outside of the time range of their chunk", v.OutOfBoundsSamples)
+	}
+
+	return v
+}
+
+// verifyChunks reads every chunk referenced by the index of the block in
+// blockDir and records the broken ones in the verification.
+func verifyChunks(logger log.Logger, blockDir string, v *blockVerification) error {
+	b, err := tsdb.OpenBlock(logger, blockDir, nil)
+	if err != nil {
+		return errors.Wrap(err, "open block")
+	}
+
+	defer runutil.CloseWithLogOnErr(logger, b, "close block")
+
+	ir, err := b.Index()
+	if err != nil {
+		return errors.Wrap(err, "open index reader")
+	}
+
+	defer runutil.CloseWithLogOnErr(logger, ir, "close index reader")
+
+	cr, err := b.Chunks()
+	if err != nil {
+		return errors.Wrap(err, "open chunk reader")
+	}
+
+	defer runutil.CloseWithLogOnErr(logger, cr, "close chunk reader")
+
+	p, err := ir.Postings(index.AllPostingsKey())
+	if err != nil {
+		return errors.Wrap(err, "get all postings")
+	}
+
+	var (
+		lset labels.Labels
+		chks []chunks.Meta
+	)
+
+	for p.Next() {
+		if err := ir.Series(p.At(), &lset, &chks); err != nil {
+			return errors.Wrap(err, "read series")
+		}
+
+		v.Series++
+
+		for _, c := range chks {
+			v.Chunks++
+
+			chk, err := cr.Chunk(c.Ref)
+			if err != nil {
+				level.Debug(logger).Log("msg", "chunk reference could not be read", "series", lset.String(), "ref", c.Ref, "err", err)
+				v.BrokenChunks++
+
+				continue
+			}
+
+			it := chk.Iterator(nil)
+			for it.Next() {
+				if t, _ := it.At(); t < c.MinTime || t > c.MaxTime {
+					v.OutOfBoundsSamples++
+				}
+			}
+
+			if err := it.Err(); err != nil {
+				level.Debug(logger).Log("msg", "chunk could not be decoded", "series", lset.String(), "ref", c.Ref, "err", err)
+				v.BrokenChunks++
+			}
+		}
+	}
+
+	return errors.Wrap(p.Err(), "walk postings")
+}
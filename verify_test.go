@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/prometheus/tsdb/testutil"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+)
+
+// testBlock writes a block with a few series to dir and uploads it to the
+// bucket. It returns the ID of the block.
+func testBlock(t *testing.T, logger log.Logger, bkt objstore.Bucket, dir string, mint, maxt int64) ulid.ULID {
+	ctx := context.Background()
+
+	h, err := tsdb.NewHead(nil, nil, nil, 10000)
+	testutil.Ok(t, err)
+
+	defer func() { testutil.Ok(t, h.Close()) }()
+
+	app := h.Appender()
+
+	for i, name := range []string{"a", "b", "c"} {
+		for ts := mint; ts < maxt; ts += 100 {
+			_, err := app.Add(labels.FromStrings("series", name), ts, float64(i))
+			testutil.Ok(t, err)
+		}
+	}
+
+	testutil.Ok(t, app.Commit())
+
+	c, err := tsdb.NewLeveledCompactor(ctx, nil, nil, []int64{1000000}, nil)
+	testutil.Ok(t, err)
+
+	id, err := c.Write(dir, h, mint, maxt, nil)
+	testutil.Ok(t, err)
+
+	_, err = metadata.InjectThanos(logger, filepath.Join(dir, id.String()), metadata.Thanos{
+		Labels:     map[string]string{"test-labelname": "test-labelvalue"},
+		Downsample: metadata.ThanosDownsample{Resolution: int64(compact.ResolutionLevelRaw)},
+		Source:     metadata.TestSource,
+	}, nil)
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, objstore.UploadDir(ctx, logger, bkt, filepath.Join(dir, id.String()), id.String()))
+
+	return id
+}
+
+func TestVerifyBlocks(t *testing.T) {
+	ctx := context.Background()
+	logger := testLogger(t.Name())
+	bkt := inmem.NewBucket()
+
+	dir, err := ioutil.TempDir("", "verify-test")
+	testutil.Ok(t, err)
+
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	healthy := testBlock(t, logger, bkt, dir, 0, 1000)
+
+	// A block missing its chunks.
+	missingChunks := testBlock(t, logger, bkt, dir, 1000, 2000)
+	testutil.Ok(t, bkt.Delete(ctx, path.Join(missingChunks.String(), "chunks", "000001")))
+
+	// A block whose meta has a narrower time range than its chunks.
+	outside := testBlock(t, logger, bkt, dir, 2000, 3000)
+
+	meta, err := metadata.Read(filepath.Join(dir, outside.String()))
+	testutil.Ok(t, err)
+
+	meta.BlockMeta.MaxTime = 2500
+
+	b, err := json.Marshal(meta)
+	testutil.Ok(t, err)
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(outside.String(), "meta.json"), bytes.NewReader(b)))
+
+	filter := testBlockFilter(logger, newReplicationMetrics(nil).blocksFiltered)
+
+	sampler := blockSampler{ratio: 1, rnd: rand.New(rand.NewSource(0))}
+	downloadDir := filepath.Join(dir, "download")
+
+	r, err := verifyBlocks(ctx, logger, bkt, filter, sampler, downloadDir)
+	testutil.Ok(t, err)
+
+	testutil.Equals(t, 3, r.Selected)
+	testutil.Equals(t, 3, r.Verified)
+	testutil.Equals(t, 2, r.Failed)
+
+	testutil.Equals(t, healthy, r.Blocks[0].ULID)
+	testutil.Equals(t, []string{}, r.Blocks[0].Errors)
+	testutil.Equals(t, 3, r.Blocks[0].Series)
+	testutil.Equals(t, 3, r.Blocks[0].Chunks)
+
+	testutil.Equals(t, missingChunks, r.Blocks[1].ULID)
+	testutil.Equals(t, 3, r.Blocks[1].BrokenChunks)
+	testutil.Equals(t, []string{"3 chunk references could not be read"}, r.Blocks[1].Errors)
+
+	testutil.Equals(t, outside, r.Blocks[2].ULID)
+	testutil.Equals(t, 3, r.Blocks[2].IndexStats.OutsideChunks)
+	testutil.Equals(t, 1, len(r.Blocks[2].Errors))
+
+	// Downloaded blocks are removed once verified.
+	files, err := ioutil.ReadDir(downloadDir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(files))
+
+	// Sampling picks a subset of the selected blocks.
+	sampler = blockSampler{ratio: 0.5, maxBlocks: 1, rnd: rand.New(rand.NewSource(0))}
+
+	r, err = verifyBlocks(ctx, logger, bkt, filter, sampler, downloadDir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, r.Selected)
+	testutil.Equals(t, 1, r.Verified)
+}